@@ -0,0 +1,298 @@
+package clickhouse
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/dogrelay/transport"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Supported insert formats
+const (
+	FormatRowBinary   = "RowBinary"
+	FormatJSONEachRow = "JSONEachRow"
+)
+
+// Supported tags layouts
+const (
+	TagsMap    = "map"    // Single Map(String, String) column
+	TagsArrays = "arrays" // Two Array(String) columns with keys and values
+)
+
+// Columns contains names of table columns
+type Columns struct {
+	Name      string // String
+	Tags      string // Map(String, String), used with TagsMap
+	TagKeys   string // Array(String), used with TagsArrays
+	TagValues string // Array(String), used with TagsArrays
+	Value     string // Int64
+	Type      string // String or LowCardinality(String) - counter, gauge or timer
+	Timestamp string // DateTime, flush time passed to Write, start of aggregated window
+}
+
+// DefaultColumns contains default column names
+var DefaultColumns = Columns{
+	Name:      "name",
+	Tags:      "tags",
+	TagKeys:   "tags.key",
+	TagValues: "tags.value",
+	Value:     "value",
+	Type:      "type",
+	Timestamp: "timestamp",
+}
+
+// Config contains ClickHouse HTTP interface settings
+type Config struct {
+	URL        string  // Base URL, like http://localhost:8123
+	Table      string  // Table name, optionally with database, like metrics.flushes
+	Format     string  // Insert format, FormatRowBinary by default
+	Tags       string  // Tags layout, TagsMap by default
+	Columns    Columns // Column names, empty ones are taken from DefaultColumns
+	Username   string
+	Password   string
+	BatchSize  int           // Max rows in single insert
+	Timeout    time.Duration // Single request timeout
+	MaxRetries int           // Retries of failed request
+	Backoff    time.Duration // Delay before first retry
+	Gzip       bool          // Compress batches
+}
+
+// Writer inserts flushed metrics into ClickHouse table
+type Writer struct {
+	url       string
+	header    http.Header
+	format    string
+	tags      string
+	columns   Columns
+	batchSize int
+	http      *transport.HTTP
+	log       xray.Ray
+}
+
+// NewWriter builds new ClickHouse writer
+func NewWriter(cfg Config) (*Writer, error) {
+	if len(cfg.URL) == 0 {
+		return nil, errors.New("empty ClickHouse URL")
+	}
+	if len(cfg.Table) == 0 {
+		return nil, errors.New("empty ClickHouse table")
+	}
+	if len(cfg.Format) == 0 {
+		cfg.Format = FormatRowBinary
+	}
+	if cfg.Format != FormatRowBinary && cfg.Format != FormatJSONEachRow {
+		return nil, fmt.Errorf("unsupported ClickHouse format %q", cfg.Format)
+	}
+	if len(cfg.Tags) == 0 {
+		cfg.Tags = TagsMap
+	}
+	if cfg.Tags != TagsMap && cfg.Tags != TagsArrays {
+		return nil, fmt.Errorf("unsupported ClickHouse tags layout %q", cfg.Tags)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 10000
+	}
+	c := &cfg.Columns
+	c.Name = orDefault(c.Name, DefaultColumns.Name)
+	c.Tags = orDefault(c.Tags, DefaultColumns.Tags)
+	c.TagKeys = orDefault(c.TagKeys, DefaultColumns.TagKeys)
+	c.TagValues = orDefault(c.TagValues, DefaultColumns.TagValues)
+	c.Value = orDefault(c.Value, DefaultColumns.Value)
+	c.Type = orDefault(c.Type, DefaultColumns.Type)
+	c.Timestamp = orDefault(c.Timestamp, DefaultColumns.Timestamp)
+
+	w := &Writer{
+		header:    http.Header{},
+		format:    cfg.Format,
+		tags:      cfg.Tags,
+		columns:   cfg.Columns,
+		batchSize: cfg.BatchSize,
+		http:      transport.NewHTTP(cfg.Timeout, cfg.MaxRetries, cfg.Backoff, cfg.Gzip),
+		log:       xray.ROOT.Fork().WithLogger("clickhouse").WithMetricPrefix("clickhouse"),
+	}
+	if len(cfg.Username) > 0 {
+		w.header.Set("X-ClickHouse-User", cfg.Username)
+		w.header.Set("X-ClickHouse-Key", cfg.Password)
+	}
+	w.url = strings.TrimRight(cfg.URL, "/") + "/?" + url.Values{"query": {w.query(cfg.Table)}}.Encode()
+
+	return w, nil
+}
+
+func orDefault(value, def string) string {
+	if len(value) == 0 {
+		return def
+	}
+	return value
+}
+
+// query builds INSERT statement
+func (w *Writer) query(table string) string {
+	columns := []string{w.columns.Name}
+	if w.tags == TagsMap {
+		columns = append(columns, w.columns.Tags)
+	} else {
+		columns = append(columns, w.columns.TagKeys, w.columns.TagValues)
+	}
+	columns = append(columns, w.columns.Value, w.columns.Type, w.columns.Timestamp)
+	for i := range columns {
+		columns[i] = quote(columns[i])
+	}
+
+	chunks := strings.Split(table, ".")
+	for i := range chunks {
+		chunks[i] = quote(chunks[i])
+	}
+
+	return "INSERT INTO " + strings.Join(chunks, ".") +
+		" (" + strings.Join(columns, ", ") + ") FORMAT " + w.format
+}
+
+// quote quotes identifier with backticks
+func quote(s string) string {
+	return "`" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "`", "\\`", -1) + "`"
+}
+
+// Write inserts events, flushed at given time, in batches. First error
+// is returned after all batches are processed.
+func (w *Writer) Write(ts time.Time, events []metrics.Event) error {
+	var first error
+	var body []byte
+	rows := 0
+	send := func() {
+		before := time.Now()
+		err := w.http.Post(w.url, w.header, body)
+		w.log.Duration("latency", time.Now().Sub(before))
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			w.log.Error("Unable to insert :count rows into ClickHouse - :err", args.Count(rows), args.Error{Err: err})
+			w.log.Inc("error", args.Type(transport.ErrorType(err)))
+		} else {
+			w.log.Inc("success")
+			w.log.Increment("rows", int64(rows))
+		}
+		body = body[:0]
+		rows = 0
+	}
+
+	for _, e := range events {
+		var err error
+		if w.format == FormatRowBinary {
+			body = w.appendRowBinary(body, ts, e)
+		} else if body, err = w.appendJSON(body, ts, e); err != nil {
+			w.log.Inc("error", args.Type("encode"))
+			continue
+		}
+		rows++
+		if rows >= w.batchSize {
+			send()
+		}
+	}
+	if rows > 0 {
+		send()
+	}
+
+	return first
+}
+
+// splitTags returns tag keys and values, sorted by key. Params without
+// value have empty values.
+func splitTags(params []string) (keys, values []string) {
+	sorted := append([]string(nil), params...)
+	sort.Strings(sorted)
+	keys = make([]string, 0, len(sorted))
+	values = make([]string, 0, len(sorted))
+	for _, p := range sorted {
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			keys = append(keys, p[:i])
+			values = append(values, p[i+1:])
+		} else {
+			keys = append(keys, p)
+			values = append(values, "")
+		}
+	}
+	return
+}
+
+// appendRowBinary appends row in RowBinary format. Strings are prefixed
+// with uvarint length, numbers are little endian, arrays and maps are
+// prefixed with uvarint elements count.
+func (w *Writer) appendRowBinary(dst []byte, ts time.Time, e metrics.Event) []byte {
+	dst = appendString(dst, e.Metric)
+	keys, values := splitTags(e.Params)
+	if w.tags == TagsMap {
+		dst = appendUvarint(dst, uint64(len(keys)))
+		for i := range keys {
+			dst = appendString(dst, keys[i])
+			dst = appendString(dst, values[i])
+		}
+	} else {
+		dst = appendUvarint(dst, uint64(len(keys)))
+		for _, k := range keys {
+			dst = appendString(dst, k)
+		}
+		dst = appendUvarint(dst, uint64(len(values)))
+		for _, v := range values {
+			dst = appendString(dst, v)
+		}
+	}
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(e.Value))
+	dst = append(dst, b[:]...)
+	dst = appendString(dst, metrics.TypeName(e.EventType))
+	binary.LittleEndian.PutUint32(b[:], uint32(ts.Unix()))
+	return append(dst, b[:4]...)
+}
+
+// appendJSON appends row in JSONEachRow format
+func (w *Writer) appendJSON(dst []byte, ts time.Time, e metrics.Event) ([]byte, error) {
+	row := map[string]interface{}{
+		w.columns.Name:      e.Metric,
+		w.columns.Value:     e.Value,
+		w.columns.Type:      metrics.TypeName(e.EventType),
+		w.columns.Timestamp: ts.Unix(),
+	}
+	keys, values := splitTags(e.Params)
+	if w.tags == TagsMap {
+		tags := make(map[string]string, len(keys))
+		for i := range keys {
+			tags[keys[i]] = values[i]
+		}
+		row[w.columns.Tags] = tags
+	} else {
+		row[w.columns.TagKeys] = keys
+		row[w.columns.TagValues] = values
+	}
+
+	bts, err := json.Marshal(row)
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, bts...)
+	return append(dst, '\n'), nil
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
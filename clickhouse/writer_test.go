@@ -0,0 +1,158 @@
+package clickhouse
+
+import (
+	"encoding/binary"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testEvents = []metrics.Event{
+	{EventType: metrics.TypeIncrement, Metric: "api.hits", Value: 3, Params: []string{"host=a", "env=live"}},
+	{EventType: metrics.TypeDuration, Metric: "api.time.perc_95", Value: -1},
+}
+
+// rowReader decodes RowBinary values
+type rowReader []byte
+
+func (r *rowReader) uvarint() uint64 {
+	v, n := binary.Uvarint(*r)
+	*r = (*r)[n:]
+	return v
+}
+
+func (r *rowReader) string() string {
+	l := r.uvarint()
+	s := string((*r)[:l])
+	*r = (*r)[l:]
+	return s
+}
+
+func (r *rowReader) strings() []string {
+	var result []string
+	for i := r.uvarint(); i > 0; i-- {
+		result = append(result, r.string())
+	}
+	return result
+}
+
+func (r *rowReader) pairs() map[string]string {
+	result := map[string]string{}
+	for i := r.uvarint(); i > 0; i-- {
+		k := r.string()
+		result[k] = r.string()
+	}
+	return result
+}
+
+func (r *rowReader) uint(size int) uint64 {
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64((*r)[i])
+	}
+	*r = (*r)[size:]
+	return v
+}
+
+func stub(t *testing.T, bodies *[]string, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "default", r.Header.Get("X-ClickHouse-User"))
+		assert.Equal(t, "secret", r.Header.Get("X-ClickHouse-Key"))
+		body, _ := ioutil.ReadAll(r.Body)
+		*bodies = append(*bodies, string(body))
+		*queries = append(*queries, r.URL.Query().Get("query"))
+	}))
+}
+
+func TestWriterRowBinary(t *testing.T) {
+	assert := assert.New(t)
+
+	var bodies, queries []string
+	server := stub(t, &bodies, &queries)
+	defer server.Close()
+
+	w, err := NewWriter(Config{URL: server.URL, Table: "db.metrics", Username: "default", Password: "secret"})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(w.Write(time.Unix(100, 0), testEvents))
+
+	assert.Equal([]string{"INSERT INTO `db`.`metrics` (`name`, `tags`, `value`, `type`, `timestamp`) FORMAT RowBinary"}, queries)
+	if assert.Len(bodies, 1) {
+		r := rowReader(bodies[0])
+		assert.Equal("api.hits", r.string())
+		assert.Equal(map[string]string{"env": "live", "host": "a"}, r.pairs())
+		assert.Equal(uint64(3), r.uint(8))
+		assert.Equal("counter", r.string())
+		assert.Equal(uint64(100), r.uint(4))
+
+		assert.Equal("api.time.perc_95", r.string())
+		assert.Empty(r.pairs())
+		assert.Equal(int64(-1), int64(r.uint(8)))
+		assert.Equal("timer", r.string())
+		assert.Equal(uint64(100), r.uint(4))
+		assert.Empty(r)
+	}
+}
+
+func TestWriterRowBinaryArrays(t *testing.T) {
+	assert := assert.New(t)
+
+	var bodies, queries []string
+	server := stub(t, &bodies, &queries)
+	defer server.Close()
+
+	w, err := NewWriter(Config{
+		URL:      server.URL,
+		Table:    "metrics",
+		Tags:     TagsArrays,
+		Columns:  Columns{Name: "metric", TagKeys: "keys", TagValues: "values"},
+		Username: "default",
+		Password: "secret",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(w.Write(time.Unix(100, 0), testEvents[:1]))
+
+	assert.Equal([]string{"INSERT INTO `metrics` (`metric`, `keys`, `values`, `value`, `type`, `timestamp`) FORMAT RowBinary"}, queries)
+	if assert.Len(bodies, 1) {
+		r := rowReader(bodies[0])
+		assert.Equal("api.hits", r.string())
+		assert.Equal([]string{"env", "host"}, r.strings())
+		assert.Equal([]string{"live", "a"}, r.strings())
+	}
+}
+
+func TestWriterJSONEachRow(t *testing.T) {
+	assert := assert.New(t)
+
+	var bodies, queries []string
+	server := stub(t, &bodies, &queries)
+	defer server.Close()
+
+	w, err := NewWriter(Config{
+		URL:       server.URL,
+		Table:     "metrics",
+		Format:    FormatJSONEachRow,
+		BatchSize: 1,
+		Username:  "default",
+		Password:  "secret",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(w.Write(time.Unix(100, 0), testEvents))
+
+	assert.Equal([]string{
+		`{"name":"api.hits","tags":{"env":"live","host":"a"},"timestamp":100,"type":"counter","value":3}` + "\n",
+		`{"name":"api.time.perc_95","tags":{},"timestamp":100,"type":"timer","value":-1}` + "\n",
+	}, bodies)
+
+	_, err = NewWriter(Config{URL: server.URL, Table: "metrics", Format: "CSV"})
+	assert.Error(err)
+}
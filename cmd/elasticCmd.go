@@ -3,10 +3,14 @@ package cmd
 import (
 	"errors"
 	"github.com/mono83/dogrelay/elastic"
+	"github.com/mono83/dogrelay/ndjson"
+	"github.com/mono83/dogrelay/spool"
 	"github.com/mono83/dogrelay/udp"
 	"github.com/mono83/xray"
 	"github.com/mono83/xray/args"
 	"github.com/spf13/cobra"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -14,9 +18,19 @@ var elasticLimitQueueCount, elasticLimitQueueSize int
 var elasticUdpBufferSize int
 var elasticUdpBind string
 var elasticClientsCount int
-var elasticDSN []string
-var elasticIndexFormat string
+var elasticClient elastic.Config
+var elasticPasswordFile, elasticAPIKeyFile, elasticTokenFile string
 var elasticEnsureTemplate bool
+var elasticTemplate elastic.TemplateConfig
+var elasticBulk elastic.BulkConfig
+var elasticEnrich elastic.EnrichConfig
+var elasticFields []string
+var elasticDLQIndex, elasticDLQFile string
+var elasticDLQMaxSize int64
+var elasticDLQMaxFiles int
+var elasticSpoolDir string
+var elasticSpoolMaxSize, elasticSpoolSegmentSize int64
+var elasticSpoolReplay time.Duration
 
 var elasticCmd = &cobra.Command{
 	Use:   "elastic",
@@ -28,27 +42,70 @@ var elasticCmd = &cobra.Command{
 		// Logging
 		checkAndRunPrometheus()
 
-		// Constructing elastic clients
+		// Constructing elastic client and bulk indexer
 		if elasticClientsCount < 1 {
 			return errors.New("at least one client expected")
 		}
-		for i := 0; i < elasticClientsCount; i++ {
-			cl, err := elastic.NewClient(elasticDSN, elasticIndexFormat, "", "")
+		if elasticTemplate.DataStream && (elastic.TimeBased(elasticClient.IndexFormat) || elastic.TimeBased(elasticClient.Fallback)) {
+			// Data stream per day is never rolled over and never deleted
+			xray.BOOT.Error("Data stream index :name must not contain time layout", args.Name(elasticClient.IndexFormat))
+			return errors.New("data stream index with time layout")
+		}
+		for _, secret := range []struct {
+			target    *string
+			env, file string
+		}{
+			{&elasticClient.Password, "ELASTIC_PASSWORD", elasticPasswordFile},
+			{&elasticClient.APIKey, "ELASTIC_API_KEY", elasticAPIKeyFile},
+			{&elasticClient.BearerToken, "ELASTIC_BEARER_TOKEN", elasticTokenFile},
+		} {
+			value, err := readSecret(secret.env, secret.file)
 			if err != nil {
+				xray.BOOT.Error("Unable to read secret - :err", args.Error{Err: err})
 				return err
 			}
-			if i == 0 && elasticEnsureTemplate {
-				if err := cl.CreateIndexTemplate(); err != nil {
-					return err
-				}
+			*secret.target = value
+		}
+		elasticClient.Timestamp = elasticEnrich.Timestamp
+		cl, err := elastic.NewClient(elasticClient)
+		if err != nil {
+			return err
+		}
+		if elasticEnsureTemplate {
+			if err := cl.EnsureTemplate(elasticTemplate); err != nil {
+				return err
 			}
-
-			go func(cl *elastic.Client) {
-				for b := range dis.Channel() {
-					_ = cl.Write(b)
-				}
-			}(cl)
 		}
+		elasticBulk.Workers = elasticClientsCount
+		elasticBulk.Create = elasticTemplate.DataStream || len(elasticClient.ID) > 0
+		indexer := elastic.NewIndexer(cl, elasticBulk)
+		onShutdown(func() { _ = indexer.Close() })
+		if len(elasticSpoolDir) > 0 {
+			sp, err := spool.Open(elasticSpoolDir, elasticSpoolMaxSize, elasticSpoolSegmentSize)
+			if err != nil {
+				return err
+			}
+			indexer.Spool(sp, elasticSpoolReplay)
+			onShutdown(func() { _ = sp.Close() })
+		}
+		if len(elasticDLQFile) > 0 {
+			f, err := ndjson.OpenRotatingFile(elasticDLQFile, elasticDLQMaxSize, elasticDLQMaxFiles)
+			if err != nil {
+				return err
+			}
+			indexer.DeadLetter(elastic.NewFileDeadLetter(f))
+			xray.BOOT.Info("Rejected documents are written to :name", args.Name(elasticDLQFile))
+		} else if len(elasticDLQIndex) > 0 {
+			indexer.DeadLetter(elastic.NewIndexDeadLetter(cl, elasticDLQIndex, elasticBulk.Timeout))
+			xray.BOOT.Info("Rejected documents are indexed into :name", args.Name(elasticDLQIndex))
+		}
+		go func() {
+			for b := range dis.Channel() {
+				if doc, err := elastic.DecodeDocument(b); err == nil {
+					indexer.Add(doc)
+				}
+			}
+		}()
 
 		// Exporting metrics
 		go func() {
@@ -63,25 +120,87 @@ var elasticCmd = &cobra.Command{
 			}
 		}()
 
-		// Starting UDP listening server
-		if err := udp.StartServer(elasticUdpBind, elasticLimitQueueSize, dis.Publish); err != nil {
+		// Starting UDP listening server, documents are validated and
+		// enriched before queueing
+		elasticEnrich.Fields = map[string]string{}
+		for _, v := range elasticFields {
+			i := strings.Index(v, "=")
+			if i < 1 {
+				xray.BOOT.Error("Field :name must be in name=value format", args.Name(v))
+				return errors.New("invalid field")
+			}
+			elasticEnrich.Fields[v[:i]] = v[i+1:]
+		}
+		enricher := elastic.NewEnricher(elasticEnrich)
+		if err := udp.StartServerFrom(elasticUdpBind, elasticLimitQueueSize, func(b []byte, from *net.UDPAddr) {
+			body, err := enricher.Enrich(b, from)
+			if err != nil {
+				indexer.QueueReject(elastic.Rejected{
+					Document: elastic.Document{Body: b},
+					Time:     time.Now(),
+					Reason:   "invalid",
+					Message:  err.Error(),
+				})
+				return
+			}
+			// Document is routed and gets ID on arrival, ID is built
+			// from payload as it was received, before enrichment
+			dis.Publish(elastic.EncodeDocument(cl.Document(b, body)))
+		}); err != nil {
 			return err
 		}
 
-		for {
-			time.Sleep(time.Second)
-		}
+		waitForShutdown()
+		return nil
 	},
 }
 
 func init() {
 	elasticCmd.Flags().BoolVarP(&elasticEnsureTemplate, "ensure", "s", false, "If true, attempts to create index template")
+	elasticCmd.Flags().StringVar(&elasticTemplate.Name, "template-name", elastic.DefaultTemplateConfig.Name, "Index template name, also prefix of component templates")
+	elasticCmd.Flags().StringArrayVar(&elasticTemplate.Patterns, "template-pattern", elastic.DefaultTemplateConfig.Patterns, "Index pattern of template, can be multiple")
+	elasticCmd.Flags().IntVar(&elasticTemplate.Priority, "template-priority", elastic.DefaultTemplateConfig.Priority, "Index template priority")
+	elasticCmd.Flags().StringVar(&elasticTemplate.File, "template-file", "", "File with index template JSON, replacing built in one")
+	elasticCmd.Flags().BoolVar(&elasticTemplate.DataStream, "data-stream", false, "If true, index is data stream, named without time pattern")
+	elasticCmd.Flags().StringVar(&elasticTemplate.Policy, "policy", "", "ILM policy name, attached to template indices")
+	elasticCmd.Flags().BoolVar(&elasticTemplate.ISM, "ism", false, "If true, policy is OpenSearch ISM policy")
 	elasticCmd.Flags().IntVar(&elasticLimitQueueCount, "limit-count", 0, "Max items in delivery queue")
 	elasticCmd.Flags().IntVar(&elasticLimitQueueSize, "limit-size", 0, "Max bytes in delivery queue")
 	elasticCmd.Flags().IntVar(&elasticUdpBufferSize, "buffer", 8*4096, "UDP buffer size")
-	elasticCmd.Flags().IntVarP(&elasticClientsCount, "count", "c", 1, "Count of clients (workers)")
+	elasticCmd.Flags().IntVarP(&elasticClientsCount, "count", "c", 1, "Count of bulk workers, each sending one bulk request at a time, shared client is used instead of one client per worker")
+	elasticCmd.Flags().IntVar(&elasticBulk.MaxCount, "bulk-count", elastic.DefaultBulkConfig.MaxCount, "Max documents in single bulk request")
+	elasticCmd.Flags().IntVar(&elasticBulk.MaxBytes, "bulk-size", elastic.DefaultBulkConfig.MaxBytes, "Max bytes of documents in single bulk request")
+	elasticCmd.Flags().DurationVar(&elasticBulk.MaxLatency, "bulk-latency", elastic.DefaultBulkConfig.MaxLatency, "Max time document waits for bulk request")
+	elasticCmd.Flags().IntVar(&elasticBulk.MaxRetries, "bulk-retries", elastic.DefaultBulkConfig.MaxRetries, "Max retries of failed bulk request or document")
+	elasticCmd.Flags().DurationVar(&elasticBulk.Backoff, "bulk-backoff", elastic.DefaultBulkConfig.Backoff, "Delay before first retry, doubled on each next one")
+	elasticCmd.Flags().DurationVar(&elasticBulk.MaxBackoff, "bulk-max-backoff", elastic.DefaultBulkConfig.MaxBackoff, "Max delay between retries")
+	elasticCmd.Flags().DurationVar(&elasticBulk.Timeout, "bulk-timeout", elastic.DefaultBulkConfig.Timeout, "Bulk request timeout")
+	elasticCmd.Flags().StringVar(&elasticEnrich.Timestamp, "timestamp-field", "@timestamp", "Field with document time, added when missing and used for time based index, empty to disable")
+	elasticCmd.Flags().StringVar(&elasticEnrich.Host, "host-field", "relay_host", "Field with receiving host name, added when missing, empty to disable")
+	elasticCmd.Flags().StringVar(&elasticEnrich.Source, "source-field", "source_ip", "Field with sender IP address, added when missing, empty to disable")
+	elasticCmd.Flags().StringArrayVar(&elasticFields, "field", nil, "Static field in name=value format, added when missing, can be multiple")
+	elasticCmd.Flags().StringVar(&elasticDLQIndex, "dlq-index", "", "Index time pattern for rejected documents, like dlq-2006.01.02")
+	elasticCmd.Flags().StringVar(&elasticDLQFile, "dlq-file", "", "NDJSON file for rejected documents, replaces DLQ index")
+	elasticCmd.Flags().Int64Var(&elasticDLQMaxSize, "dlq-max-size", 100<<20, "Rotate DLQ file when it grows over given size in bytes, zero to disable")
+	elasticCmd.Flags().IntVar(&elasticDLQMaxFiles, "dlq-max-files", 5, "Amount of rotated DLQ files to keep")
+	elasticCmd.Flags().StringVar(&elasticSpoolDir, "spool-dir", "", "Directory to spool documents, failed after retries, empty to drop them")
+	elasticCmd.Flags().Int64Var(&elasticSpoolMaxSize, "spool-max-size", 1<<30, "Max bytes of spooled documents, 0 for no limit")
+	elasticCmd.Flags().Int64Var(&elasticSpoolSegmentSize, "spool-segment-size", 16<<20, "Max bytes of single spool segment file")
+	elasticCmd.Flags().DurationVar(&elasticSpoolReplay, "spool-replay-interval", 10*time.Second, "Interval of spool replay attempts")
 	elasticCmd.Flags().StringVar(&elasticUdpBind, "bind", "", "UDP bind address")
-	elasticCmd.Flags().StringVar(&elasticIndexFormat, "index", "logstash-2006.01.02", "Index time pattern according to Go time formatter")
+	elasticCmd.Flags().StringVar(&elasticClient.IndexFormat, "index", "logstash-2006.01.02", "Index pattern, Go time layout with document fields in braces, like logs-{app}-2006.01.02")
+	elasticCmd.Flags().DurationVar(&elasticClient.MaxSkew, "max-skew", 7*24*time.Hour, "Max distance of document time from now, documents beyond it go to index of arrival time, zero for no limit")
+	elasticCmd.Flags().StringVar(&elasticClient.ID, "id", "", "Document ID: hash for content hash or field names, like rayId+seq, documents are created only once")
+	elasticCmd.Flags().StringVar(&elasticClient.Fallback, "index-fallback", "", "Index time pattern for documents without pattern fields, by default fields are replaced with unknown")
 	elasticCmd.Flags().StringVarP(&prometheusBind, "export-prometheus", "e", "", "Starts Prometheus exporter on given address, like :12345")
-	elasticCmd.Flags().StringArrayVar(&elasticDSN, "elastic", []string{"http://localhost:9200"}, "ElasticSearch DSN, can be multiple")
+	elasticCmd.Flags().StringArrayVar(&elasticClient.Addresses, "elastic", []string{"http://localhost:9200"}, "ElasticSearch DSN, can be multiple")
+	elasticCmd.Flags().StringVar(&elasticClient.CloudID, "elastic-cloud-id", "", "Elastic Cloud deployment ID, replaces DSN")
+	elasticCmd.Flags().StringVar(&elasticClient.Username, "elastic-user", "", "Basic auth user, password is read from ELASTIC_PASSWORD or --elastic-password-file")
+	elasticCmd.Flags().StringVar(&elasticPasswordFile, "elastic-password-file", "", "File with basic auth password")
+	elasticCmd.Flags().StringVar(&elasticAPIKeyFile, "elastic-api-key-file", "", "File with base64 encoded API key, by default read from ELASTIC_API_KEY")
+	elasticCmd.Flags().StringVar(&elasticTokenFile, "elastic-token-file", "", "File with bearer token, by default read from ELASTIC_BEARER_TOKEN")
+	elasticCmd.Flags().StringVar(&elasticClient.CAFile, "elastic-ca", "", "PEM file with certificate authorities to verify server")
+	elasticCmd.Flags().StringVar(&elasticClient.CertFile, "elastic-cert", "", "PEM file with client certificate for mutual TLS")
+	elasticCmd.Flags().StringVar(&elasticClient.KeyFile, "elastic-key", "", "PEM file with client certificate key")
+	elasticCmd.Flags().BoolVar(&elasticClient.InsecureSkipVerify, "elastic-insecure", false, "If true, server certificate is not verified")
 }
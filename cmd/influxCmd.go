@@ -3,22 +3,59 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"github.com/mono83/dogrelay/clickhouse"
+	"github.com/mono83/dogrelay/datadog"
+	"github.com/mono83/dogrelay/graphite"
+	"github.com/mono83/dogrelay/influxdb"
 	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/dogrelay/ndjson"
+	"github.com/mono83/dogrelay/opentsdb"
+	"github.com/mono83/dogrelay/prometheus"
+	"github.com/mono83/dogrelay/remotewrite"
+	"github.com/mono83/dogrelay/sink"
+	"github.com/mono83/dogrelay/statsd"
 	"github.com/mono83/dogrelay/udp"
 	v "github.com/mono83/validate"
 	"github.com/mono83/xray"
 	"github.com/mono83/xray/args"
 	"github.com/spf13/cobra"
+	"io"
 	"os"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var influxCmdPktSize int
-var influxCmdBind, influxCmdInfluxHost, influxCmdPercString string
+// flushInterval is interval of buffer flushes
+const flushInterval = 10 * time.Second
+
+var influxCmdPktSize, influxCmdShards, influxCmdSendZeros, influxCmdEvictIdle, influxCmdPayloadSize int
+var influxCmdBind, influxCmdPercString, influxCmdUDPPrecision string
+var influxCmdInfluxHosts, influxCmdInfluxURLs []string
+var influxCmdSinkQueue int
+var influxCmdSinkTimeout time.Duration
 var influxCmdCompatMode bool
+var influxCmdGaugeMode string
+var influxCmdGaugeRules []string
+var influxCmdHTTP influxdb.HTTPConfig
+var influxCmdPromBind string
+var influxCmdPromMappings []string
+var influxCmdPromTTL time.Duration
+var influxCmdRemoteWrite remotewrite.Config
+var influxCmdRemoteWriteLabels []string
+var influxCmdGraphite graphite.Config
+var influxCmdStatsD statsd.Config
+var influxCmdStatsDRaw bool
+var influxCmdOpenTSDB opentsdb.Config
+var influxCmdOpenTSDBTags []string
+var influxCmdDatadog datadog.Config
+var influxCmdDatadogEnabled bool
+var influxCmdNDJSON string
+var influxCmdNDJSONMaxSize int64
+var influxCmdNDJSONMaxFiles int
+var influxCmdClickHouse = clickhouse.Config{Backoff: 500 * time.Millisecond}
 
 var influxCmd = &cobra.Command{
 	Use:   "statsd-influx",
@@ -26,7 +63,6 @@ var influxCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, a []string) error {
 		if err := v.All(
 			v.WithMessage(v.StringNotWhitespace(influxCmdPercString), "Percentiles not provided"),
-			v.WithMessage(v.StringNotWhitespace(influxCmdInfluxHost), "InfluxDB host not provided"),
 			v.WithMessage(v.StringNotWhitespace(influxCmdBind), "Binding address not provided"),
 		); err != nil {
 			return err
@@ -57,8 +93,57 @@ var influxCmd = &cobra.Command{
 			xray.BOOT.Info("StatsD compatible outgoing metrics suffixes disabled")
 		}
 
-		buf := metrics.NewBuffer(percentiles, influxCmdCompatMode)
-		err := udp.StartMetricsServer(influxCmdBind, influxCmdPktSize, buf.Add)
+		// Parsing gauge aggregation modes
+		gaugeMode, err := metrics.ParseGaugeMode(influxCmdGaugeMode)
+		if err != nil {
+			xray.BOOT.Error("Error parsing gauge mode - :err", args.Error{Err: err})
+			return err
+		}
+		var gaugeRules []metrics.GaugeRule
+		for _, v := range influxCmdGaugeRules {
+			rule, err := metrics.ParseGaugeRule(v)
+			if err != nil {
+				xray.BOOT.Error("Error parsing gauge rule - :err", args.Error{Err: err})
+				return err
+			}
+			gaugeRules = append(gaugeRules, rule)
+			xray.BOOT.Info(
+				"Gauges matching :name will be aggregated as :type",
+				args.Name(rule.Pattern),
+				args.Type(rule.Mode.String()),
+			)
+		}
+
+		buf := metrics.NewShardedBuffer(influxCmdShards, percentiles, influxCmdCompatMode)
+		buf.SetGaugeModes(gaugeMode, gaugeRules)
+		buf.SetSendZeros(influxCmdSendZeros)
+		buf.SetEvictIdle(influxCmdEvictIdle)
+		if influxCmdSendZeros > 0 {
+			xray.BOOT.Info("Idle counters and timers will report zeros during :count windows", args.Count(influxCmdSendZeros))
+		}
+		xray.BOOT.Info("Metrics buffer partitioned into :count shards", args.Count(buf.Shards()))
+		checkAndRestoreBufferState(buf)
+
+		var relay *statsd.Relay
+		if len(influxCmdStatsD.Upstreams) > 0 {
+			relay, err = statsd.NewRelay(influxCmdStatsD)
+			if err != nil {
+				xray.BOOT.Error("Error configuring StatsD relay - :err", args.Error{Err: err})
+				return err
+			}
+			xray.BOOT.Info("Relaying data to :count StatsD upstreams", args.Count(len(influxCmdStatsD.Upstreams)))
+		}
+
+		to := buf.AddKey
+		if relay != nil && influxCmdStatsDRaw {
+			// Raw events are relayed as they arrive, aggregation
+			// is left to upstreams
+			to = func(key []byte, value int64) {
+				relay.Add(key, value)
+				buf.AddKey(key, value)
+			}
+		}
+		err = udp.StartMetricsServer(influxCmdBind, influxCmdPktSize, to)
 		if err != nil {
 			xray.BOOT.Error("Error starting UDP server - :err", args.Error{Err: err})
 			return err
@@ -69,17 +154,171 @@ var influxCmd = &cobra.Command{
 			args.Count(influxCmdPktSize),
 		)
 
-		var inf *udp.InfluxDBSender
-		if len(influxCmdInfluxHost) > 0 {
-			inf, err = udp.NewInfluxDBSender(influxCmdInfluxHost)
+		fan := sink.NewFanOut()
+		var closers []io.Closer
+		if relay != nil && !influxCmdStatsDRaw {
+			fan.Add("statsd", relay, influxCmdSinkQueue, influxCmdSinkTimeout)
+		}
+		for _, host := range influxCmdInfluxHosts {
+			inf, err := udp.NewInfluxDBSender(
+				host,
+				influxCmdPayloadSize,
+				influxdb.Encoder{Precision: influxCmdUDPPrecision, Fields: influxCmdHTTP.Fields},
+			)
 			if err != nil {
 				xray.BOOT.Error("Error starting InfluxDB  - :err", args.Error{Err: err})
 				return err
 			}
-			xray.BOOT.Info(
-				"Forwarding data to InfluxDB on :addr",
-				args.String{N: "addr", V: influxCmdBind},
-			)
+			fan.Add("influxdb-udp-"+host, inf, influxCmdSinkQueue, influxCmdSinkTimeout)
+			xray.BOOT.Info("Forwarding data to InfluxDB on :addr", args.Addr(host))
+		}
+
+		if len(influxCmdHTTP.Password) == 0 {
+			influxCmdHTTP.Password = os.Getenv("INFLUX_PASSWORD")
+		}
+		if len(influxCmdHTTP.Token) == 0 {
+			influxCmdHTTP.Token = os.Getenv("INFLUX_TOKEN")
+		}
+		for _, url := range influxCmdInfluxURLs {
+			cfg := influxCmdHTTP
+			cfg.URL = url
+			infHTTP, err := influxdb.NewHTTPWriter(cfg)
+			if err != nil {
+				xray.BOOT.Error("Error configuring InfluxDB HTTP writer - :err", args.Error{Err: err})
+				return err
+			}
+			fan.Add("influxdb-http-"+url, infHTTP, influxCmdSinkQueue, influxCmdSinkTimeout)
+			xray.BOOT.Info("Forwarding data to InfluxDB HTTP API on :addr", args.Addr(url))
+		}
+
+		if len(influxCmdPromBind) > 0 {
+			var mappings []prometheus.Mapping
+			for _, v := range influxCmdPromMappings {
+				m, err := prometheus.ParseMapping(v)
+				if err != nil {
+					xray.BOOT.Error("Error parsing Prometheus mapping - :err", args.Error{Err: err})
+					return err
+				}
+				mappings = append(mappings, m)
+			}
+			prom := prometheus.NewExporter(mappings, influxCmdPromTTL)
+			fan.Add("prometheus", prom, influxCmdSinkQueue, influxCmdSinkTimeout)
+			go func() {
+				if err := prom.ListenAndServe(influxCmdPromBind); err != nil {
+					xray.BOOT.Error("Error starting Prometheus metrics endpoint - :err", args.Error{Err: err})
+				}
+			}()
+		}
+
+		if len(influxCmdRemoteWrite.URL) > 0 {
+			influxCmdRemoteWrite.ExternalLabels = map[string]string{}
+			for _, v := range influxCmdRemoteWriteLabels {
+				i := strings.IndexByte(v, '=')
+				if i < 1 {
+					xray.BOOT.Error("Remote write label :name must be in name=value format", args.Name(v))
+					return errors.New("invalid remote write label")
+				}
+				influxCmdRemoteWrite.ExternalLabels[v[:i]] = v[i+1:]
+			}
+			if len(influxCmdRemoteWrite.Password) == 0 {
+				influxCmdRemoteWrite.Password = os.Getenv("REMOTE_WRITE_PASSWORD")
+			}
+			if len(influxCmdRemoteWrite.BearerToken) == 0 {
+				influxCmdRemoteWrite.BearerToken = os.Getenv("REMOTE_WRITE_TOKEN")
+			}
+			rw, err := remotewrite.NewWriter(influxCmdRemoteWrite)
+			if err != nil {
+				xray.BOOT.Error("Error configuring Prometheus remote write - :err", args.Error{Err: err})
+				return err
+			}
+			fan.Add("remote-write", rw, influxCmdSinkQueue, influxCmdSinkTimeout)
+			xray.BOOT.Info("Forwarding data to Prometheus remote write endpoint :addr", args.Addr(influxCmdRemoteWrite.URL))
+		}
+
+		if len(influxCmdGraphite.Addr) > 0 {
+			gr, err := graphite.NewSender(influxCmdGraphite)
+			if err != nil {
+				xray.BOOT.Error("Error configuring Graphite sender - :err", args.Error{Err: err})
+				return err
+			}
+			fan.Add("graphite", gr, influxCmdSinkQueue, influxCmdSinkTimeout)
+			closers = append(closers, gr)
+			xray.BOOT.Info("Forwarding data to Graphite on :addr", args.Addr(influxCmdGraphite.Addr))
+		}
+
+		if len(influxCmdOpenTSDB.URL) > 0 {
+			influxCmdOpenTSDB.Tags = map[string]string{}
+			for _, v := range influxCmdOpenTSDBTags {
+				i := strings.IndexByte(v, '=')
+				if i < 1 || i == len(v)-1 {
+					xray.BOOT.Error("OpenTSDB tag :name must be in name=value format", args.Name(v))
+					return errors.New("invalid OpenTSDB tag")
+				}
+				influxCmdOpenTSDB.Tags[v[:i]] = v[i+1:]
+			}
+			if len(influxCmdOpenTSDB.APIKey) == 0 {
+				influxCmdOpenTSDB.APIKey = os.Getenv("OPENTSDB_API_KEY")
+			}
+			tsdb, err := opentsdb.NewWriter(influxCmdOpenTSDB)
+			if err != nil {
+				xray.BOOT.Error("Error configuring OpenTSDB writer - :err", args.Error{Err: err})
+				return err
+			}
+			fan.Add("opentsdb", tsdb, influxCmdSinkQueue, influxCmdSinkTimeout)
+			xray.BOOT.Info("Forwarding data to OpenTSDB on :addr", args.Addr(influxCmdOpenTSDB.URL))
+		}
+
+		if influxCmdDatadogEnabled {
+			if len(influxCmdDatadog.APIKey) == 0 {
+				influxCmdDatadog.APIKey = os.Getenv("DD_API_KEY")
+			}
+			if len(influxCmdDatadog.Host) == 0 {
+				influxCmdDatadog.Host, _ = os.Hostname()
+			}
+			influxCmdDatadog.Interval = 10
+			dd, err := datadog.NewWriter(influxCmdDatadog)
+			if err != nil {
+				xray.BOOT.Error("Error configuring Datadog writer - :err", args.Error{Err: err})
+				return err
+			}
+			fan.Add("datadog", dd, influxCmdSinkQueue, influxCmdSinkTimeout)
+			xray.BOOT.Info("Forwarding data to Datadog API on :addr", args.Addr(influxCmdDatadog.URL))
+		}
+
+		if len(influxCmdClickHouse.URL) > 0 {
+			if len(influxCmdClickHouse.Password) == 0 {
+				influxCmdClickHouse.Password = os.Getenv("CLICKHOUSE_PASSWORD")
+			}
+			ch, err := clickhouse.NewWriter(influxCmdClickHouse)
+			if err != nil {
+				xray.BOOT.Error("Error configuring ClickHouse writer - :err", args.Error{Err: err})
+				return err
+			}
+			fan.Add("clickhouse", ch, influxCmdSinkQueue, influxCmdSinkTimeout)
+			xray.BOOT.Info("Writing data to ClickHouse table :name on :addr", args.Name(influxCmdClickHouse.Table), args.Addr(influxCmdClickHouse.URL))
+		}
+
+		if influxCmdNDJSON == "-" {
+			fan.Add("ndjson", ndjson.NewWriter(os.Stdout), influxCmdSinkQueue, influxCmdSinkTimeout)
+		} else if len(influxCmdNDJSON) > 0 {
+			f, err := ndjson.OpenRotatingFile(influxCmdNDJSON, influxCmdNDJSONMaxSize, influxCmdNDJSONMaxFiles)
+			if err != nil {
+				xray.BOOT.Error("Error opening NDJSON file - :err", args.Error{Err: err})
+				return err
+			}
+			fan.Add("ndjson", ndjson.NewWriter(f), influxCmdSinkQueue, influxCmdSinkTimeout)
+			closers = append(closers, f)
+			xray.BOOT.Info("Writing flushed data to :name", args.Name(influxCmdNDJSON))
+		}
+
+		if fan.Len() == 0 && relay == nil {
+			fan.Add("stdout", sink.Func(func(_ time.Time, events []metrics.Event) error {
+				fmt.Println()
+				for _, e := range events {
+					fmt.Println(e.Value, "\t", e.Key())
+				}
+				return nil
+			}), influxCmdSinkQueue, influxCmdSinkTimeout)
 		}
 
 		name, err := os.Hostname()
@@ -94,20 +333,36 @@ var influxCmd = &cobra.Command{
 		params := []string{"hostname=" + name}
 		checkAndRunPrometheus()
 
-		for {
-			time.Sleep(10 * time.Second)
-			before := time.Now()
-			toSend, rawCount, aggCount := buf.Flush(10)
-			if inf == nil {
-				fmt.Println()
-				for _, e := range toSend {
-					fmt.Println(e.Value, "\t", e.Key())
-				}
-			} else {
-				for _, e := range toSend {
-					inf.Send(e)
+		// Queued flushes are delivered before sinks are closed
+		onShutdown(func() {
+			_ = fan.Close()
+			for _, c := range closers {
+				if err := c.Close(); err != nil {
+					xray.BOOT.Error("Error closing sink - :err", args.Error{Err: err})
 				}
 			}
+		})
+		if relay != nil {
+			// Relay gets last flush from fan out, so it is closed after it
+			onShutdown(func() { _ = relay.Close() })
+		}
+
+		// Flushes happen on interval boundaries and are stamped with
+		// start of flushed window
+		ticker := metrics.NewTicker(flushInterval)
+		defer ticker.Stop()
+		signals := shutdownSignal()
+		for {
+			var window time.Time
+			select {
+			case <-signals:
+				shutdown()
+				return nil
+			case window = <-ticker.C:
+			}
+			before := time.Now()
+			toSend, rawCount, aggCount := buf.Flush(int(flushInterval / time.Second))
+			_ = fan.Write(window, toSend)
 
 			// Adding system metric to inform about time spent to aggregate data
 			buf.Add(metrics.Event{
@@ -138,9 +393,93 @@ var influxCmd = &cobra.Command{
 
 func init() {
 	influxCmd.Flags().IntVar(&influxCmdPktSize, "size", 4096, "Packet size limit")
+	influxCmd.Flags().IntVar(&influxCmdShards, "shards", runtime.NumCPU(), "Amount of independently locked buffer partitions")
 	influxCmd.Flags().StringVar(&influxCmdBind, "bind", "", "Listening port and address, for example localhost:8080")
-	influxCmd.Flags().StringVar(&influxCmdInfluxHost, "influx", "", "InfluxDB target address and port to forward data")
+	influxCmd.Flags().StringArrayVar(&influxCmdInfluxHosts, "influx", nil, "InfluxDB target address and port to forward data, can be multiple")
+	influxCmd.Flags().IntVar(&influxCmdPayloadSize, "influx-payload", udp.DefaultPayloadSize, "Max size of single datagram, sent to InfluxDB")
+	influxCmd.Flags().StringVar(&influxCmdUDPPrecision, "influx-udp-precision", "ns", "Precision of flush window timestamps over UDP, must match InfluxDB UDP listener - ns, us, ms or s, empty to omit them")
+	influxCmd.Flags().StringArrayVar(&influxCmdInfluxURLs, "influx-http", nil, "InfluxDB HTTP API address to forward data, like http://localhost:8086, can be multiple")
+	influxCmd.Flags().IntVar(&influxCmdHTTP.Version, "influx-api", 1, "InfluxDB HTTP API version, 1 or 2")
+	influxCmd.Flags().StringVar(&influxCmdHTTP.Database, "influx-db", "", "InfluxDB database (API v1)")
+	influxCmd.Flags().StringVar(&influxCmdHTTP.RetentionPolicy, "influx-rp", "", "InfluxDB retention policy (API v1)")
+	influxCmd.Flags().StringVar(&influxCmdHTTP.Username, "influx-user", "", "InfluxDB user name (API v1), password is read from INFLUX_PASSWORD")
+	influxCmd.Flags().StringVar(&influxCmdHTTP.Org, "influx-org", "", "InfluxDB organization (API v2)")
+	influxCmd.Flags().StringVar(&influxCmdHTTP.Bucket, "influx-bucket", "", "InfluxDB bucket (API v2), token is read from INFLUX_TOKEN")
+	influxCmd.Flags().StringVar(&influxCmdHTTP.Precision, "influx-precision", "s", "Precision of flush window timestamps over HTTP - ns, us, ms or s, empty to omit them")
+	influxCmd.Flags().BoolVar(&influxCmdHTTP.Fields, "influx-fields", false, "Write timer statistics as fields of single point instead of suffixed measurements")
+	influxCmd.Flags().IntVar(&influxCmdHTTP.BatchSize, "influx-batch", 5000, "Max lines in single InfluxDB HTTP request")
+	influxCmd.Flags().DurationVar(&influxCmdHTTP.Timeout, "influx-timeout", 5*time.Second, "InfluxDB HTTP request timeout")
+	influxCmd.Flags().IntVar(&influxCmdHTTP.MaxRetries, "influx-retries", 3, "Max retries of failed InfluxDB HTTP request")
+	influxCmd.Flags().DurationVar(&influxCmdHTTP.Backoff, "influx-backoff", 500*time.Millisecond, "Delay before first retry, doubled on each next one")
+	influxCmd.Flags().BoolVar(&influxCmdHTTP.Gzip, "influx-gzip", true, "Compress InfluxDB HTTP requests")
+	influxCmd.Flags().StringVar(&influxCmdPromBind, "prometheus-bind", "", "Serve aggregated metrics for Prometheus on given address, like :9102")
+	influxCmd.Flags().StringArrayVar(&influxCmdPromMappings, "prometheus-map", nil, "Prometheus mapping rule, like api.*.hits=api_hits,endpoint=$1, can be multiple")
+	influxCmd.Flags().DurationVar(&influxCmdPromTTL, "prometheus-ttl", 0, "Remove Prometheus series not updated for given time, zero to keep forever")
+	influxCmd.Flags().StringVar(&influxCmdRemoteWrite.URL, "remote-write", "", "Prometheus remote write endpoint, like http://localhost:9009/api/v1/push")
+	influxCmd.Flags().StringArrayVar(&influxCmdRemoteWriteLabels, "remote-write-label", nil, "External label, added to all remote write series, like cluster=eu, can be multiple")
+	influxCmd.Flags().IntVar(&influxCmdRemoteWrite.BatchSize, "remote-write-batch", 2000, "Max samples in single remote write request")
+	influxCmd.Flags().DurationVar(&influxCmdRemoteWrite.Timeout, "remote-write-timeout", 5*time.Second, "Remote write request timeout")
+	influxCmd.Flags().IntVar(&influxCmdRemoteWrite.MaxRetries, "remote-write-retries", 3, "Max retries of failed remote write request")
+	influxCmd.Flags().DurationVar(&influxCmdRemoteWrite.Backoff, "remote-write-backoff", 500*time.Millisecond, "Delay before first remote write retry, doubled on each next one")
+	influxCmd.Flags().DurationVar(&influxCmdRemoteWrite.TTL, "remote-write-ttl", time.Hour, "Reset remote write counters not updated for given time, zero to keep forever")
+	influxCmd.Flags().StringVar(&influxCmdRemoteWrite.Username, "remote-write-user", "", "Remote write basic auth user, password is read from REMOTE_WRITE_PASSWORD, bearer token from REMOTE_WRITE_TOKEN")
+	influxCmd.Flags().StringVar(&influxCmdGraphite.Addr, "graphite", "", "Graphite carbon address to forward data over TCP, like localhost:2003")
+	influxCmd.Flags().BoolVar(&influxCmdGraphite.Encoder.Pickle, "graphite-pickle", false, "Use Graphite pickle protocol instead of plaintext, usually on port 2004")
+	influxCmd.Flags().StringVar(&influxCmdGraphite.Encoder.Tags, "graphite-tags", graphite.TagsNative, "Graphite tags mode - tags for ;tag=value or path to fold them into path")
+	influxCmd.Flags().StringVar(&influxCmdGraphite.Encoder.Template, "graphite-template", graphite.DefaultTemplate, "Graphite path template in path tags mode, like servers.{host}.{metric}.{tags}")
+	influxCmd.Flags().IntVar(&influxCmdGraphite.BatchSize, "graphite-batch", 500, "Max metrics in single Graphite write")
+	influxCmd.Flags().IntVar(&influxCmdGraphite.BufferSize, "graphite-buffer", 8<<20, "Max bytes waiting to be sent to Graphite, oldest data is dropped on overflow")
+	influxCmd.Flags().DurationVar(&influxCmdGraphite.Timeout, "graphite-timeout", 5*time.Second, "Graphite connect, write and shutdown flush timeout")
+	influxCmd.Flags().StringArrayVar(&influxCmdStatsD.Upstreams, "statsd", nil, "Upstream StatsD address to relay data to, can be multiple, series are sharded by consistent hashing")
+	influxCmd.Flags().BoolVar(&influxCmdStatsDRaw, "statsd-raw", false, "Relay raw incoming events instead of aggregated ones")
+	influxCmd.Flags().IntVar(&influxCmdStatsD.Replicas, "statsd-replicas", statsd.DefaultReplicas, "Virtual nodes of every StatsD upstream on hash ring")
+	influxCmd.Flags().IntVar(&influxCmdStatsD.PayloadSize, "statsd-payload", statsd.DefaultPayloadSize, "Max size of single datagram, sent to StatsD upstream")
+	influxCmd.Flags().DurationVar(&influxCmdStatsD.CheckInterval, "statsd-check", 5*time.Second, "Interval of StatsD upstreams health checks, zero to disable them")
+	influxCmd.Flags().StringVar(&influxCmdOpenTSDB.URL, "opentsdb", "", "OpenTSDB HTTP API address to forward data, like http://localhost:4242, API key is read from OPENTSDB_API_KEY")
+	influxCmd.Flags().StringVar(&influxCmdOpenTSDB.APIKeyHeader, "opentsdb-key-header", "X-Api-Key", "Header to send OpenTSDB API key in")
+	influxCmd.Flags().IntVar(&influxCmdOpenTSDB.BatchSize, "opentsdb-batch", 50, "Max data points in single OpenTSDB request")
+	influxCmd.Flags().DurationVar(&influxCmdOpenTSDB.Timeout, "opentsdb-timeout", 5*time.Second, "OpenTSDB request timeout")
+	influxCmd.Flags().IntVar(&influxCmdOpenTSDB.MaxRetries, "opentsdb-retries", 3, "Max retries of failed OpenTSDB request")
+	influxCmd.Flags().DurationVar(&influxCmdOpenTSDB.Backoff, "opentsdb-backoff", 500*time.Millisecond, "Delay before first OpenTSDB retry, doubled on each next one")
+	influxCmd.Flags().StringArrayVar(&influxCmdOpenTSDBTags, "opentsdb-tag", nil, "Tag, added to all OpenTSDB data points, like env=live, can be multiple. Points without tags get "+opentsdb.DefaultTagName+"="+opentsdb.DefaultTagValue)
+	influxCmd.Flags().BoolVar(&influxCmdOpenTSDB.Gzip, "opentsdb-gzip", true, "Compress OpenTSDB requests")
+	influxCmd.Flags().BoolVar(&influxCmdDatadogEnabled, "datadog", false, "Forward data to Datadog series API, API key is read from DD_API_KEY")
+	influxCmd.Flags().StringVar(&influxCmdDatadog.URL, "datadog-url", datadog.DefaultURL, "Datadog compatible API address")
+	influxCmd.Flags().StringArrayVar(&influxCmdDatadog.Tags, "datadog-tag", nil, "Tag, added to all Datadog series, like env:live, can be multiple")
+	influxCmd.Flags().IntVar(&influxCmdDatadog.BatchSize, "datadog-batch", 1000, "Max series in single Datadog request")
+	influxCmd.Flags().DurationVar(&influxCmdDatadog.Timeout, "datadog-timeout", 5*time.Second, "Datadog request timeout")
+	influxCmd.Flags().IntVar(&influxCmdDatadog.MaxRetries, "datadog-retries", 3, "Max retries of failed Datadog request")
+	influxCmd.Flags().DurationVar(&influxCmdDatadog.Backoff, "datadog-backoff", 500*time.Millisecond, "Delay before first Datadog retry, doubled on each next one")
+	influxCmd.Flags().BoolVar(&influxCmdDatadog.Gzip, "datadog-gzip", true, "Compress Datadog requests")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.URL, "clickhouse", "", "ClickHouse HTTP interface address to write data, like http://localhost:8123")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Table, "clickhouse-table", "metrics", "ClickHouse table, optionally with database, like stats.metrics")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Format, "clickhouse-format", clickhouse.FormatRowBinary, "ClickHouse insert format - RowBinary or JSONEachRow")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Tags, "clickhouse-tags", clickhouse.TagsMap, "ClickHouse tags layout - map for Map(String, String) column or arrays for keys and values columns")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Columns.Name, "clickhouse-col-name", clickhouse.DefaultColumns.Name, "ClickHouse column for metric name")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Columns.Tags, "clickhouse-col-tags", clickhouse.DefaultColumns.Tags, "ClickHouse column for tags map")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Columns.TagKeys, "clickhouse-col-tag-keys", clickhouse.DefaultColumns.TagKeys, "ClickHouse column for tag keys array")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Columns.TagValues, "clickhouse-col-tag-values", clickhouse.DefaultColumns.TagValues, "ClickHouse column for tag values array")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Columns.Value, "clickhouse-col-value", clickhouse.DefaultColumns.Value, "ClickHouse column for value")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Columns.Type, "clickhouse-col-type", clickhouse.DefaultColumns.Type, "ClickHouse column for metric type")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Columns.Timestamp, "clickhouse-col-timestamp", clickhouse.DefaultColumns.Timestamp, "ClickHouse column for flush time, start of aggregated window")
+	influxCmd.Flags().StringVar(&influxCmdClickHouse.Username, "clickhouse-user", "", "ClickHouse user, password is read from CLICKHOUSE_PASSWORD")
+	influxCmd.Flags().IntVar(&influxCmdClickHouse.BatchSize, "clickhouse-batch", 10000, "Max rows in single ClickHouse insert")
+	influxCmd.Flags().DurationVar(&influxCmdClickHouse.Timeout, "clickhouse-timeout", 10*time.Second, "ClickHouse request timeout")
+	influxCmd.Flags().IntVar(&influxCmdClickHouse.MaxRetries, "clickhouse-retries", 3, "Max retries of failed ClickHouse insert")
+	influxCmd.Flags().BoolVar(&influxCmdClickHouse.Gzip, "clickhouse-gzip", true, "Compress ClickHouse inserts")
+	influxCmd.Flags().StringVar(&influxCmdNDJSON, "ndjson", "", "Write flushed data as NDJSON into given file, - for stdout")
+	influxCmd.Flags().Int64Var(&influxCmdNDJSONMaxSize, "ndjson-max-size", 100<<20, "Rotate NDJSON file when it grows over given size in bytes, zero to disable")
+	influxCmd.Flags().IntVar(&influxCmdNDJSONMaxFiles, "ndjson-max-files", 5, "Amount of rotated NDJSON files to keep")
+	influxCmd.Flags().IntVar(&influxCmdSinkQueue, "sink-queue", sink.DefaultQueueSize, "Flushes waiting for delivery in queue of every sink, oldest are dropped on overflow")
+	influxCmd.Flags().DurationVar(&influxCmdSinkTimeout, "sink-timeout", sink.DefaultTimeout, "Time to wait for single sink write")
 	influxCmd.Flags().StringVar(&influxCmdPercString, "percentiles", "95,98", "Percentiles to calculate, comma separated")
 	influxCmd.Flags().BoolVar(&influxCmdCompatMode, "compat", false, "StatsD compatible metrics mode. Will append .counter and .gauge for metrics")
+	influxCmd.Flags().StringVar(&influxCmdGaugeMode, "gauge-mode", "last", "Default gauge aggregation mode: last, min, max, avg, sum or all")
+	influxCmd.Flags().StringArrayVar(&influxCmdGaugeRules, "gauge-rule", nil, "Gauge aggregation mode for metrics matching glob, like cpu.*=max, can be multiple")
+	influxCmd.Flags().IntVar(&influxCmdEvictIdle, "evict-idle", 0, "Amount of idle windows before series of any type, gauges included, are forgotten, zero to keep them forever")
+	influxCmd.Flags().IntVar(&influxCmdSendZeros, "send-zeros", 0, "Amount of idle windows to report zeros for counters and timer counts before forgetting them")
+	influxCmd.Flags().StringVar(&stateFile, "state-file", "", "File to persist gauges (and optionally counters) across restarts")
+	influxCmd.Flags().DurationVar(&stateInterval, "state-interval", time.Minute, "Interval of periodic state snapshots, zero to save only on shutdown")
+	influxCmd.Flags().BoolVar(&stateCounters, "state-counters", false, "Include counters and timers of current window into state snapshots, they are restored only from snapshot younger than flush window")
 	influxCmd.Flags().StringVarP(&prometheusBind, "export-prometheus", "e", "", "Starts Prometheus exporter on given address, like :12345")
 }
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"os"
+	"time"
+)
+
+var stateFile string
+var stateInterval time.Duration
+var stateCounters bool
+
+// checkAndRestoreBufferState checks, if state file is configured and if true
+// restores buffer from it and starts periodic and on shutdown snapshots
+func checkAndRestoreBufferState(buf *metrics.Buffer) {
+	if len(stateFile) == 0 {
+		return
+	}
+
+	log := xray.ROOT.Fork().WithLogger("state").WithMetricPrefix("state")
+	buf.SetStateMaxAge(flushInterval)
+	count, err := buf.LoadState(stateFile)
+	if os.IsNotExist(err) {
+		xray.BOOT.Info("No buffer state found at :name", args.Name(stateFile))
+	} else if err != nil {
+		xray.BOOT.Error("Unable to restore buffer state from :name - :err", args.Name(stateFile), args.Error{Err: err})
+	} else {
+		xray.BOOT.Info("Restored :count series from :name", args.Count(count), args.Name(stateFile))
+	}
+
+	save := func() {
+		before := time.Now()
+		if err := buf.SaveState(stateFile, stateCounters); err != nil {
+			log.Error("Unable to save buffer state - :err", args.Error{Err: err})
+			log.Inc("error")
+		} else {
+			log.Duration("save", time.Now().Sub(before))
+		}
+	}
+
+	// Periodic snapshots
+	if stateInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(stateInterval)
+				save()
+			}
+		}()
+	}
+
+	// Snapshot on shutdown
+	onShutdown(func() {
+		save()
+		xray.BOOT.Info("Buffer state saved to :name", args.Name(stateFile))
+	})
+}
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// readSecret returns secret from given file, if its name is not empty,
+// or from environment variable otherwise. Secrets are not taken from
+// command line, where they are visible in process list.
+func readSecret(env, file string) (string, error) {
+	if len(file) == 0 {
+		return os.Getenv(env), nil
+	}
+	bts, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bts)), nil
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"github.com/mono83/xray"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var shutdownLock sync.Mutex
+var shutdownHooks []func()
+
+// onShutdown registers function, invoked on graceful shutdown in
+// registration order
+func onShutdown(f func()) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// shutdownSignal returns channel, receiving SIGINT and SIGTERM
+func shutdownSignal() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return signals
+}
+
+// waitForShutdown blocks until termination signal and runs shutdown hooks
+func waitForShutdown() {
+	<-shutdownSignal()
+	shutdown()
+}
+
+// shutdown runs registered shutdown hooks. Second termination signal,
+// received meanwhile, terminates application immediately.
+func shutdown() {
+	xray.BOOT.Info("Shutting down")
+	go func() {
+		<-shutdownSignal()
+		os.Exit(1)
+	}()
+
+	shutdownLock.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownLock.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+	xray.BOOT.Info("Shutdown complete")
+}
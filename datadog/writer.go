@@ -0,0 +1,145 @@
+package datadog
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/dogrelay/transport"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultURL is Datadog API address for US1 site
+const DefaultURL = "https://api.datadoghq.com"
+
+// Config contains Datadog series API settings
+type Config struct {
+	URL        string        // Base URL, DefaultURL when empty
+	APIKey     string        // API key, sent in DD-API-KEY header
+	Host       string        // Host name, attached to every series
+	Tags       []string      // Tags in name:value format, attached to every series
+	Interval   int64         // Flush interval in seconds, used for counters
+	BatchSize  int           // Max series in single request
+	Timeout    time.Duration // Single request timeout
+	MaxRetries int           // Retries of failed request
+	Backoff    time.Duration // Delay before first retry
+	Gzip       bool          // Compress batches
+}
+
+// Writer sends flushed metrics to Datadog compatible /api/v1/series
+// endpoint. Counters are sent with count type, all other values as
+// gauges.
+type Writer struct {
+	url       string
+	header    http.Header
+	host      string
+	tags      []string
+	interval  int64
+	batchSize int
+	http      *transport.HTTP
+	log       xray.Ray
+}
+
+type payload struct {
+	Series []series `json:"series"`
+}
+
+type series struct {
+	Metric   string       `json:"metric"`
+	Points   [][2]float64 `json:"points"`
+	Type     string       `json:"type"`
+	Interval int64        `json:"interval,omitempty"`
+	Host     string       `json:"host,omitempty"`
+	Tags     []string     `json:"tags,omitempty"`
+}
+
+// NewWriter builds new Datadog writer
+func NewWriter(cfg Config) (*Writer, error) {
+	if len(cfg.APIKey) == 0 {
+		return nil, errors.New("empty Datadog API key")
+	}
+	if len(cfg.URL) == 0 {
+		cfg.URL = DefaultURL
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+
+	w := &Writer{
+		url:       strings.TrimRight(cfg.URL, "/") + "/api/v1/series",
+		header:    http.Header{},
+		host:      cfg.Host,
+		tags:      cfg.Tags,
+		interval:  cfg.Interval,
+		batchSize: cfg.BatchSize,
+		http:      transport.NewHTTP(cfg.Timeout, cfg.MaxRetries, cfg.Backoff, cfg.Gzip),
+		log:       xray.ROOT.Fork().WithLogger("datadog").WithMetricPrefix("datadog"),
+	}
+	w.header.Set("Content-Type", "application/json")
+	w.header.Set("DD-API-KEY", cfg.APIKey)
+
+	return w, nil
+}
+
+// Write sends events, flushed at given time, to Datadog in batches.
+// First error is returned after all batches are processed.
+func (w *Writer) Write(ts time.Time, events []metrics.Event) error {
+	var first error
+	p := payload{Series: make([]series, 0, w.batchSize)}
+	send := func() {
+		before := time.Now()
+		body, err := json.Marshal(p)
+		if err == nil {
+			err = w.http.Post(w.url, w.header, body)
+		}
+		w.log.Duration("latency", time.Now().Sub(before))
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			w.log.Error("Unable to submit :count series to Datadog - :err", args.Count(len(p.Series)), args.Error{Err: err})
+			w.log.Inc("error", args.Type(transport.ErrorType(err)))
+		} else {
+			w.log.Inc("success")
+			w.log.Increment("series", int64(len(p.Series)))
+		}
+		p.Series = p.Series[:0]
+	}
+
+	for _, e := range events {
+		p.Series = append(p.Series, w.series(ts, e))
+		if len(p.Series) >= w.batchSize {
+			send()
+		}
+	}
+	if len(p.Series) > 0 {
+		send()
+	}
+
+	return first
+}
+
+// series converts event into Datadog series with single point
+func (w *Writer) series(ts time.Time, e metrics.Event) series {
+	s := series{
+		Metric: e.Metric,
+		Points: [][2]float64{{float64(ts.Unix()), float64(e.Value)}},
+		Type:   "gauge",
+		Host:   w.host,
+	}
+	if e.EventType == metrics.TypeIncrement {
+		s.Type = "count"
+		s.Interval = w.interval
+	}
+	if len(e.Params)+len(w.tags) > 0 {
+		s.Tags = make([]string, 0, len(e.Params)+len(w.tags))
+		for _, p := range e.Params {
+			s.Tags = append(s.Tags, strings.Replace(p, "=", ":", 1))
+		}
+		s.Tags = append(s.Tags, w.tags...)
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+package datadog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	var batches []payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// Throttled request is retried
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		assert.Equal("/api/v1/series", r.URL.Path)
+		assert.Equal("secret", r.Header.Get("DD-API-KEY"))
+		assert.Equal("gzip", r.Header.Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(r.Body)
+		if assert.NoError(err) {
+			var p payload
+			assert.NoError(json.NewDecoder(gz).Decode(&p))
+			batches = append(batches, p)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	w, err := NewWriter(Config{
+		URL:        server.URL,
+		APIKey:     "secret",
+		Host:       "relay1",
+		Tags:       []string{"env:live"},
+		Interval:   10,
+		BatchSize:  1,
+		MaxRetries: 1,
+		Gzip:       true,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(w.Write(time.Unix(100, 0), []metrics.Event{
+		{EventType: metrics.TypeIncrement, Metric: "api.hits", Value: 5, Params: []string{"host=a", "canary"}},
+		{EventType: metrics.TypeDuration, Metric: "api.time.perc_95", Value: 12},
+	}))
+
+	assert.Equal([]payload{
+		{Series: []series{{
+			Metric:   "api.hits",
+			Points:   [][2]float64{{100, 5}},
+			Type:     "count",
+			Interval: 10,
+			Host:     "relay1",
+			Tags:     []string{"host:a", "canary", "env:live"},
+		}}},
+		{Series: []series{{
+			Metric: "api.time.perc_95",
+			Points: [][2]float64{{100, 12}},
+			Type:   "gauge",
+			Host:   "relay1",
+			Tags:   []string{"env:live"},
+		}}},
+	}, batches)
+
+	_, err = NewWriter(Config{URL: server.URL})
+	assert.Error(err)
+}
@@ -0,0 +1,96 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/mono83/dogrelay/transport"
+	"io/ioutil"
+	"strings"
+)
+
+// Document is single document, waiting for indexing
+type Document struct {
+	Index string // Target index
+	ID    string // Document ID, empty to let Elasticsearch generate it
+	Body  []byte // Compact single line JSON
+}
+
+// bulkResponse is response of bulk API
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+
+// bulkItem is result of single bulk operation
+type bulkItem struct {
+	Index  string   `json:"_index"`
+	ID     string   `json:"_id"`
+	Status int      `json:"status"`
+	Error  *esError `json:"error"`
+}
+
+// Temporary returns true if failed operation may succeed when retried
+func (i bulkItem) Temporary() bool {
+	return i.Status >= 500 || i.Status == 429
+}
+
+// appendAction appends bulk action line and document source
+func appendAction(buf *bytes.Buffer, action string, doc Document) {
+	buf.WriteString(`{"`)
+	buf.WriteString(action)
+	buf.WriteString(`":{"_index":`)
+	writeJSONString(buf, doc.Index)
+	if len(doc.ID) > 0 {
+		buf.WriteString(`,"_id":`)
+		writeJSONString(buf, doc.ID)
+	}
+	buf.WriteString("}}\n")
+	buf.Write(doc.Body)
+	buf.WriteByte('\n')
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	bts, _ := json.Marshal(s)
+	buf.Write(bts)
+}
+
+// bulk sends given documents in single bulk request with given action,
+// index or create, and returns results in same order. Failure of whole
+// request is returned as error, transport.StatusError for non 2xx responses.
+func (c *Client) bulk(ctx context.Context, action string, docs []Document, buf *bytes.Buffer) ([]bulkItem, error) {
+	buf.Reset()
+	for _, doc := range docs {
+		appendAction(buf, action, doc)
+	}
+
+	req := esapi.BulkRequest{Body: bytes.NewReader(buf.Bytes())}
+	res, err := req.Do(ctx, c.client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, transport.StatusError{Code: res.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	var response bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if len(response.Items) != len(docs) {
+		return nil, errUnexpectedItems
+	}
+
+	items := make([]bulkItem, len(docs))
+	for i, item := range response.Items {
+		// Single key, named after action
+		for _, result := range item {
+			items[i] = result
+		}
+	}
+	return items, nil
+}
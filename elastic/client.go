@@ -2,36 +2,108 @@ package elastic
 
 import (
 	"bytes"
-	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/mono83/xray"
 	"github.com/mono83/xray/args"
-	"strings"
+	"io/ioutil"
+	"net/http"
 	"time"
 )
 
 // Client is a wrapper over Elasticsearch client
 type Client struct {
-	client      *elasticsearch.Client
-	logger      xray.Ray
-	indexFormat string
+	client *elasticsearch.Client
+	logger xray.Ray
+	router *Router
+	id     IDFunc
+}
+
+// Config contains Elasticsearch connection settings
+type Config struct {
+	Addresses   []string      // Node addresses, ignored when CloudID is set
+	CloudID     string        // Elastic Cloud deployment ID
+	IndexFormat string        // Index pattern, Go time layout with document fields in braces
+	Fallback    string        // Index time pattern for documents without pattern fields
+	Timestamp   string        // Field with document time, choosing time based index
+	MaxSkew     time.Duration // Max distance of document time from now, arrival time is used beyond it, zero for no limit
+	ID          string        // Document ID spec, "hash" or field names, like rayId+seq
+
+	Username    string // Basic auth user
+	Password    string // Basic auth password
+	APIKey      string // Base64 encoded API key, overrides basic auth
+	BearerToken string // Bearer (service account) token, overrides basic auth
+
+	CAFile             string // PEM file with certificate authorities
+	CertFile           string // PEM file with client certificate for mutual TLS
+	KeyFile            string // PEM file with client certificate key
+	InsecureSkipVerify bool   // Do not verify server certificate
+}
+
+// tlsConfig builds TLS settings, nil when defaults are enough
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if (len(c.CertFile) > 0) != (len(c.KeyFile) > 0) {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if len(c.CAFile) == 0 && len(c.CertFile) == 0 && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if len(c.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if len(c.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
 
 // NewClient constructs new Elasticsearch client
-func NewClient(addresses []string, indexFormat, user, pass string) (*Client, error) {
-	for _, addr := range addresses {
-		xray.BOOT.Info("ElasticSearch address is :addr", args.Addr(addr))
+func NewClient(c Config) (*Client, error) {
+	if len(c.CloudID) > 0 {
+		xray.BOOT.Info("ElasticSearch cloud ID is :name", args.Name(c.CloudID))
+	} else {
+		for _, addr := range c.Addresses {
+			xray.BOOT.Info("ElasticSearch address is :addr", args.Addr(addr))
+		}
 	}
 	cfg := elasticsearch.Config{
-		Addresses: addresses,
-		Username:  user,
-		Password:  pass,
-		//EnableRetryOnTimeout: true, // deprecated
-		//DiscoverNodesOnStart: true,
+		Addresses:    c.Addresses,
+		CloudID:      c.CloudID,
+		Username:     c.Username,
+		Password:     c.Password,
+		APIKey:       c.APIKey,
+		ServiceToken: c.BearerToken,
+
+		// Retries are made by Indexer with knowledge of per document results
+		DisableRetry: true,
+	}
+	if len(c.CloudID) > 0 {
+		cfg.Addresses = nil
+	}
+	tlsCfg, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsCfg
+		cfg.Transport = t
 	}
 	es, err := elasticsearch.NewClient(cfg)
 	if err != nil {
@@ -42,81 +114,42 @@ func NewClient(addresses []string, indexFormat, user, pass string) (*Client, err
 		return nil, err
 	}
 	defer res.Body.Close()
+	if err := responseError(res); err != nil {
+		return nil, err
+	}
 
-	infoResult := map[string]interface{}{}
-	if err := json.NewDecoder(res.Body).Decode(&infoResult); err != nil {
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
 		return nil, err
 	}
 	xray.BOOT.Info("Elasticsearch client: :version", args.String{N: "version", V: elasticsearch.Version})
-	xray.BOOT.Info("Elasticsearch server: :version", args.String{N: "version", V: infoResult["version"].(map[string]interface{})["number"].(string)})
+	xray.BOOT.Info("Elasticsearch server: :version", args.String{N: "version", V: info.Version.Number})
 
+	router := NewRouter(c.IndexFormat, c.Fallback, c.Timestamp)
+	router.SetMaxSkew(c.MaxSkew)
 	return &Client{
-		client:      es,
-		logger:      xray.ROOT.Fork().WithLogger("elastic").WithMetricPrefix("elastic"),
-		indexFormat: indexFormat,
+		client: es,
+		logger: xray.ROOT.Fork().WithLogger("elastic").WithMetricPrefix("elastic"),
+		router: router,
+		id:     NewIDFunc(c.ID),
 	}, nil
 }
 
-// CreateIndexTemplate creates standard ES template for logs.
-func (c *Client) CreateIndexTemplate() error {
-	req := esapi.IndicesPutTemplateRequest{
-		Name:   "logstash",
-		Create: refBool(true),
-		Body:   strings.NewReader(indexTemplateString),
-	}
-	res, err := req.Do(context.TODO(), c.client)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		var e esErrorResponse
-		if err := json.NewDecoder(res.Body).Decode(&e); err == nil {
-			if strings.HasSuffix(e.Error.Reason, "already exists") {
-				xray.BOOT.Info("Index template already exists")
-				return nil
-			} else {
-				xray.BOOT.Error("Reason - :err", args.Error{Err: e.Error})
-			}
+// Document builds document with given compact body, routed to index by
+// its content and current time. ID is built from original payload, so
+// same payload gets same ID however it is enriched.
+func (c *Client) Document(original, body []byte) Document {
+	doc := Document{Index: c.router.Index(body, time.Now()), Body: body}
+	if c.id != nil {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, original); err == nil {
+			original = buf.Bytes()
 		}
-		xray.BOOT.Error("Template creation failed - :err", args.Error{Err: errors.New(res.Status())})
-	} else {
-		xray.BOOT.Info("Template created")
-	}
-	return nil
-}
-
-// Write writes data to ES
-func (c *Client) Write(b []byte) error {
-	req := esapi.IndexRequest{
-		Index:      time.Now().Format(c.indexFormat),
-		Body:       bytes.NewReader(b),
-		Refresh:    "true",
-		DocumentID: "",
+		doc.ID = c.id(original)
 	}
-
-	// Performing request
-	res, err := req.Do(context.Background(), c.client)
-	if err != nil {
-		c.logger.Error("WTF - :err", args.Error{Err: err})
-		c.logger.Inc("error", args.Type("io"))
-		return err
-	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		c.logger.Error(res.Status())
-		c.logger.Inc("error", args.Type("derived"))
-		return fmt.Errorf("error indexing " + res.Status())
-	}
-
-	fmt.Println(time.Now().Format(c.indexFormat))
-	fmt.Println(string(b))
-
-	return nil
-}
-
-func refBool(b bool) *bool {
-	return &b
+	return doc
 }
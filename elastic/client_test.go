@@ -0,0 +1,73 @@
+package elastic
+
+import (
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewClientAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	var auth string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		if len(auth) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":{"type":"security_exception","reason":"missing authentication credentials"},"status":401}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"version":{"number":"8.0.0"}}`))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "elastic")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	assert.NoError(ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0644))
+
+	// Unknown certificate authority
+	_, err = NewClient(Config{Addresses: []string{s.URL}, Username: "elastic", Password: "secret"})
+	assert.Error(err)
+
+	// Authentication failure is reported
+	_, err = NewClient(Config{Addresses: []string{s.URL}, CAFile: ca})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "missing authentication credentials")
+	}
+
+	for _, c := range []struct {
+		cfg  Config
+		auth string
+	}{
+		{Config{Username: "elastic", Password: "secret", CAFile: ca}, "Basic ZWxhc3RpYzpzZWNyZXQ="},
+		{Config{APIKey: "a2V5OnNlY3JldA==", CAFile: ca}, "APIKey a2V5OnNlY3JldA=="},
+		{Config{BearerToken: "token", InsecureSkipVerify: true}, "Bearer token"},
+	} {
+		c.cfg.Addresses = []string{s.URL}
+		_, err := NewClient(c.cfg)
+		assert.NoError(err)
+		assert.Equal(c.auth, auth)
+	}
+
+	// Invalid TLS files
+	_, err = NewClient(Config{Addresses: []string{s.URL}, CAFile: filepath.Join(dir, "missing.pem")})
+	assert.Error(err)
+	_, err = NewClient(Config{Addresses: []string{s.URL}, CertFile: ca, KeyFile: ca})
+	assert.Error(err)
+
+	// Certificate and key are required together
+	_, err = NewClient(Config{Addresses: []string{s.URL}, CAFile: ca, Username: "elastic", KeyFile: ca})
+	assert.Error(err)
+	_, err = NewClient(Config{Addresses: []string{s.URL}, CAFile: ca, Username: "elastic", CertFile: ca})
+	assert.Error(err)
+}
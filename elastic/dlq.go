@@ -0,0 +1,101 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Rejected is document, rejected by Elasticsearch or failed validation
+type Rejected struct {
+	Document
+	Time    time.Time
+	Reason  string // Error type, like mapper_parsing_exception
+	Message string // Error reason
+}
+
+// appendRecord appends dead letter record, with original document as string
+func (r Rejected) appendRecord(buf *bytes.Buffer) {
+	buf.WriteString(`{"@timestamp":"`)
+	buf.WriteString(r.Time.Format(TimestampFormat))
+	buf.WriteString(`","index":`)
+	writeJSONString(buf, r.Index)
+	buf.WriteString(`,"reason":`)
+	writeJSONString(buf, r.Reason)
+	buf.WriteString(`,"error":`)
+	writeJSONString(buf, r.Message)
+	buf.WriteString(`,"payload":`)
+	writeJSONString(buf, string(r.Body))
+	buf.WriteByte('}')
+}
+
+// DeadLetter stores rejected documents, so they are not lost silently
+type DeadLetter interface {
+	Write([]Rejected) error
+}
+
+// NewFileDeadLetter builds dead letter queue, that writes rejected
+// documents as NDJSON records into given writer
+func NewFileDeadLetter(w io.Writer) DeadLetter {
+	return &fileDeadLetter{w: w}
+}
+
+type fileDeadLetter struct {
+	m   sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (f *fileDeadLetter) Write(records []Rejected) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.buf.Reset()
+	for _, r := range records {
+		r.appendRecord(&f.buf)
+		f.buf.WriteByte('\n')
+	}
+	_, err := f.w.Write(f.buf.Bytes())
+	return err
+}
+
+// NewIndexDeadLetter builds dead letter queue, that indexes rejected
+// documents into index, named after given time pattern. Records keep
+// original document as string, so they never conflict with mappings.
+func NewIndexDeadLetter(c *Client, indexFormat string, timeout time.Duration) DeadLetter {
+	return &indexDeadLetter{client: c, indexFormat: indexFormat, timeout: timeout}
+}
+
+type indexDeadLetter struct {
+	client      *Client
+	indexFormat string
+	timeout     time.Duration
+}
+
+func (d *indexDeadLetter) Write(records []Rejected) error {
+	docs := make([]Document, len(records))
+	for i, r := range records {
+		var buf bytes.Buffer
+		r.appendRecord(&buf)
+		docs[i] = Document{Index: r.Time.Format(d.indexFormat), Body: buf.Bytes()}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	var buf bytes.Buffer
+	items, err := d.client.bulk(ctx, "index", docs, &buf)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.Status >= 300 {
+			if item.Error != nil {
+				return item.Error
+			}
+			return fmt.Errorf("dead letter rejected with status %d", item.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileDeadLetter(t *testing.T) {
+	var buf bytes.Buffer
+	d := NewFileDeadLetter(&buf)
+	assert.NoError(t, d.Write([]Rejected{
+		{
+			Document: Document{Index: "logs", Body: []byte(`{"n":"x"}`)},
+			Time:     time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			Reason:   "mapper_parsing_exception",
+			Message:  "failed to parse field [n]",
+		},
+		{Document: Document{Body: []byte("not json")}, Time: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC), Reason: "invalid"},
+	}))
+	assert.Equal(
+		t,
+		`{"@timestamp":"2021-01-02T03:04:05.000Z","index":"logs","reason":"mapper_parsing_exception","error":"failed to parse field [n]","payload":"{\"n\":\"x\"}"}`+"\n"+
+			`{"@timestamp":"2021-01-02T03:04:05.000Z","index":"","reason":"invalid","error":"","payload":"not json"}`+"\n",
+		buf.String(),
+	)
+}
+
+func TestIndexerDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+	f.item = func(doc fakeDoc) (int, string) {
+		if doc.Body == `{"n":"conflict"}` {
+			return 400, "mapper_parsing_exception"
+		}
+		return 201, ""
+	}
+
+	c := newTestClient(t, f)
+	i := NewIndexer(c, BulkConfig{MaxLatency: time.Hour})
+	i.DeadLetter(NewIndexDeadLetter(c, "dlq-2006", time.Second))
+	i.Add(Document{Index: "x", Body: []byte(`{"n":"ok"}`)})
+	i.Add(Document{Index: "x", Body: []byte(`{"n":"conflict"}`)})
+	assert.NoError(i.Close())
+
+	docs := f.received()
+	if assert.Len(docs, 2) {
+		assert.Equal(`{"n":"ok"}`, docs[0].Body)
+		assert.Equal(time.Now().Format("dlq-2006"), docs[1].Index)
+		var record map[string]string
+		assert.NoError(json.Unmarshal([]byte(docs[1].Body), &record))
+		assert.Equal("x", record["index"])
+		assert.Equal("mapper_parsing_exception", record["reason"])
+		assert.Equal("mapper_parsing_exception failure", record["error"])
+		assert.Equal(`{"n":"conflict"}`, record["payload"])
+	}
+}
+
+func TestIndexerQueueReject(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+
+	// Queue is bounded, overflow is dropped without blocking
+	block := make(chan struct{})
+	dead := &blockingDeadLetter{block: block}
+	i := NewIndexer(newTestClient(t, f), BulkConfig{MaxCount: 2, MaxLatency: time.Hour})
+	i.DeadLetter(dead)
+	for j := 0; j < 10; j++ {
+		i.QueueReject(Rejected{Document: Document{Body: []byte("not json")}, Reason: "invalid"})
+	}
+	close(block)
+	assert.NoError(i.Close())
+	dead.m.Lock()
+	defer dead.m.Unlock()
+	// Queued documents and one, taken before block
+	assert.True(dead.count >= 2 && dead.count <= 3)
+
+	// Rejects after close are ignored
+	i.QueueReject(Rejected{})
+}
+
+type blockingDeadLetter struct {
+	block chan struct{}
+	m     sync.Mutex
+	count int
+}
+
+func (b *blockingDeadLetter) Write(records []Rejected) error {
+	<-b.block
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.count += len(records)
+	return nil
+}
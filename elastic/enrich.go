@@ -0,0 +1,114 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// TimestampFormat is format of injected timestamps, accepted by default
+// date mapping of Elasticsearch
+const TimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// EnrichConfig contains document enrichment settings. Fields are added
+// only when document has no field with same name, empty names disable
+// corresponding enrichment.
+type EnrichConfig struct {
+	Timestamp string            // Field with receive time, like @timestamp
+	Host      string            // Field with name of receiving host
+	Source    string            // Field with IP address of sender
+	Fields    map[string]string // Static fields
+}
+
+// Enricher validates incoming documents and adds fields to them
+type Enricher struct {
+	cfg    EnrichConfig
+	log    xray.Ray
+	static []field // Static fields and host, sorted by name
+	now    func() time.Time
+}
+
+type field struct {
+	name  string
+	value []byte // Encoded JSON value
+}
+
+// NewEnricher constructs new enricher
+func NewEnricher(cfg EnrichConfig) *Enricher {
+	e := &Enricher{
+		cfg: cfg,
+		log: xray.ROOT.Fork().WithLogger("elastic").WithMetricPrefix("elastic"),
+		now: time.Now,
+	}
+	for name, value := range cfg.Fields {
+		bts, _ := json.Marshal(value)
+		e.static = append(e.static, field{name: name, value: bts})
+	}
+	if len(cfg.Host) > 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			xray.BOOT.Error("Unable to obtain hostname - :err", args.Error{Err: err})
+		} else {
+			bts, _ := json.Marshal(host)
+			e.static = append(e.static, field{name: cfg.Host, value: bts})
+		}
+	}
+	sort.Slice(e.static, func(i, j int) bool { return e.static[i].name < e.static[j].name })
+	return e
+}
+
+// Enrich validates JSON object, received from given address, and returns
+// it compacted into single line with missing fields added. Invalid
+// documents are counted and returned with error.
+func (e *Enricher) Enrich(b []byte, from net.Addr) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		e.log.Inc("invalid", args.Type("json"))
+		return nil, err
+	}
+	if fields == nil {
+		e.log.Inc("invalid", args.Type("json"))
+		return nil, ErrNotObject
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(b) + 128)
+	if err := json.Compact(&buf, b); err != nil {
+		e.log.Inc("invalid", args.Type("json"))
+		return nil, err
+	}
+	buf.Truncate(buf.Len() - 1) // Closing brace
+
+	empty := len(fields) == 0
+	add := func(name string, value []byte) {
+		if _, ok := fields[name]; ok {
+			return
+		}
+		fields[name] = nil
+		if !empty {
+			buf.WriteByte(',')
+		}
+		empty = false
+		writeJSONString(&buf, name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	if len(e.cfg.Timestamp) > 0 {
+		add(e.cfg.Timestamp, []byte(`"`+e.now().Format(TimestampFormat)+`"`))
+	}
+	if len(e.cfg.Source) > 0 {
+		if addr, ok := from.(*net.UDPAddr); ok && addr != nil {
+			add(e.cfg.Source, []byte(`"`+addr.IP.String()+`"`))
+		}
+	}
+	for _, f := range e.static {
+		add(f.name, f.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,48 @@
+package elastic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnricher(t *testing.T) {
+	assert := assert.New(t)
+
+	host, _ := os.Hostname()
+	e := NewEnricher(EnrichConfig{
+		Timestamp: "@timestamp",
+		Host:      "relay_host",
+		Source:    "source_ip",
+		Fields:    map[string]string{"env": "prod", "dc": "eu"},
+	})
+	e.now = func() time.Time { return time.Date(2021, 3, 4, 5, 6, 7, 8e6, time.UTC) }
+	from := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+
+	out, err := e.Enrich([]byte("{\n  \"message\": \"hello\"\n}"), from)
+	assert.NoError(err)
+	assert.Equal(
+		`{"message":"hello","@timestamp":"2021-03-04T05:06:07.008Z","source_ip":"10.0.0.1","dc":"eu","env":"prod","relay_host":"`+host+`"}`,
+		string(out),
+	)
+
+	// Existing fields are kept
+	out, err = e.Enrich([]byte(`{"@timestamp":"2020-01-01T00:00:00Z","env":"dev","source_ip":null}`), nil)
+	assert.NoError(err)
+	assert.Equal(`{"@timestamp":"2020-01-01T00:00:00Z","env":"dev","source_ip":null,"dc":"eu","relay_host":"`+host+`"}`, string(out))
+
+	// Empty object
+	out, err = NewEnricher(EnrichConfig{Timestamp: "ts"}).Enrich([]byte(`{}`), from)
+	assert.NoError(err)
+	assert.Contains(string(out), `{"ts":"`)
+
+	// Invalid documents
+	for _, doc := range []string{`not json`, `{"a":1`, `{"a":1} {}`, `[1,2]`, `null`, `"string"`} {
+		_, err := e.Enrich([]byte(doc), from)
+		assert.Error(err, doc)
+	}
+	_, err = e.Enrich([]byte(`null`), from)
+	assert.Equal(ErrNotObject, err)
+}
@@ -1,5 +1,14 @@
 package elastic
 
+import "errors"
+
+// ErrNotObject is returned for documents, that are valid JSON, but not objects
+var ErrNotObject = errors.New("document is not JSON object")
+
+// errUnexpectedItems is returned when bulk response items do not match
+// sent documents
+var errUnexpectedItems = errors.New("bulk response items count does not match request")
+
 type esErrorResponse struct {
 	Error esError `json:"error"`
 }
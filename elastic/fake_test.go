@@ -0,0 +1,121 @@
+package elastic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDoc is document, received by fake Elasticsearch in bulk request
+type fakeDoc struct {
+	Action string
+	Index  string
+	ID     string
+	Body   string
+}
+
+// fakeElastic is minimal Elasticsearch stub, serving info and bulk
+// endpoints. Other requests are recorded and answered with 200.
+type fakeElastic struct {
+	*httptest.Server
+
+	m        sync.Mutex
+	docs     []fakeDoc
+	bulks    int
+	requests []string // Method and path of non bulk requests
+	bodies   map[string]string
+
+	// failRequests is amount of bulk requests to fail with 503
+	failRequests int
+	// item returns status and error type for document, nil means 201
+	item func(doc fakeDoc) (int, string)
+	// responses contains status and body of non bulk requests by method
+	// and path, missing ones are acknowledged
+	responses map[string]fakeResponse
+}
+
+type fakeResponse struct {
+	Status int
+	Body   string
+}
+
+func newFakeElastic(t testing.TB) *fakeElastic {
+	f := &fakeElastic{bodies: map[string]string{}, responses: map[string]fakeResponse{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeElastic) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/":
+		_, _ = w.Write([]byte(`{"version":{"number":"8.0.0"}}`))
+	case strings.HasSuffix(r.URL.Path, "/_bulk"):
+		f.bulks++
+		if f.failRequests > 0 {
+			f.failRequests--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"error":{"type":"unavailable","reason":"try later"}}`))
+			return
+		}
+
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 1<<20), 16<<20)
+		for scanner.Scan() {
+			var action map[string]struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var doc fakeDoc
+			for name, meta := range action {
+				doc = fakeDoc{Action: name, Index: meta.Index, ID: meta.ID, Body: scanner.Text()}
+			}
+			status, errType := 201, ""
+			if f.item != nil {
+				status, errType = f.item(doc)
+			}
+			if status < 300 {
+				f.docs = append(f.docs, doc)
+				items = append(items, fmt.Sprintf(`{%q:{"_index":%q,"status":%d}}`, doc.Action, doc.Index, status))
+			} else {
+				items = append(items, fmt.Sprintf(
+					`{%q:{"_index":%q,"status":%d,"error":{"type":%q,"reason":"%s failure"}}}`,
+					doc.Action, doc.Index, status, errType, errType,
+				))
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	default:
+		body, _ := ioutil.ReadAll(r.Body)
+		key := r.Method + " " + r.URL.Path
+		f.requests = append(f.requests, key)
+		f.bodies[key] = string(body)
+		if res, ok := f.responses[key]; ok {
+			w.WriteHeader(res.Status)
+			_, _ = w.Write([]byte(res.Body))
+			return
+		}
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	}
+}
+
+func (f *fakeElastic) received() []fakeDoc {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]fakeDoc(nil), f.docs...)
+}
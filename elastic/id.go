@@ -0,0 +1,54 @@
+package elastic
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"strings"
+)
+
+// maxIDLength is max length of document ID, allowed by Elasticsearch
+const maxIDLength = 512
+
+// IDFunc builds document ID from compact JSON document body
+type IDFunc func(body []byte) string
+
+// NewIDFunc builds document ID function from given spec. Spec "hash"
+// means ID is content hash, field names, joined with plus, like
+// rayId+seq, mean ID is built from their values, separated with dash.
+// Documents without such fields get content hash. Empty spec means no
+// IDs, they are generated by Elasticsearch.
+func NewIDFunc(spec string) IDFunc {
+	switch spec {
+	case "":
+		return nil
+	case "hash":
+		return HashID
+	}
+	fields := strings.Split(spec, "+")
+	return func(body []byte) string {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return HashID(body)
+		}
+		values := make([]string, len(fields))
+		for i, f := range fields {
+			values[i] = stringValue(lookup(doc, f))
+			if len(values[i]) == 0 {
+				return HashID(body)
+			}
+		}
+		id := strings.Join(values, "-")
+		if len(id) > maxIDLength {
+			return HashID(body)
+		}
+		return id
+	}
+}
+
+// HashID returns 128 bit FNV-1a hash of document body as ID
+func HashID(body []byte) string {
+	h := fnv.New128a()
+	_, _ = h.Write(body)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,103 @@
+package elastic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewIDFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(NewIDFunc(""))
+
+	hash := NewIDFunc("hash")
+	a, b := hash([]byte(`{"n":1}`)), hash([]byte(`{"n":2}`))
+	assert.Len(a, 22)
+	assert.NotEqual(a, b)
+	assert.Equal(a, hash([]byte(`{"n":1}`)))
+
+	fields := NewIDFunc("rayId+meta.seq")
+	assert.Equal("abc-3", fields([]byte(`{"rayId":"abc","meta":{"seq":3}}`)))
+	assert.Equal(HashID([]byte(`{"rayId":"abc"}`)), fields([]byte(`{"rayId":"abc"}`)))
+	long := `{"rayId":"` + strings.Repeat("a", 600) + `","meta":{"seq":1}}`
+	assert.Equal(HashID([]byte(long)), fields([]byte(long)))
+}
+
+func TestIndexerIdempotent(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+	seen := map[string]bool{}
+	f.item = func(doc fakeDoc) (int, string) {
+		if seen[doc.ID] {
+			return 409, "version_conflict_engine_exception"
+		}
+		seen[doc.ID] = true
+		return 201, ""
+	}
+
+	c, err := NewClient(Config{Addresses: []string{f.URL}, IndexFormat: "logs", ID: "rayId+seq"})
+	if !assert.NoError(err) {
+		return
+	}
+	i := NewIndexer(c, BulkConfig{MaxCount: 1, MaxLatency: time.Hour, Create: true})
+	dead := &collectDeadLetter{}
+	i.DeadLetter(dead)
+	assert.NoError(i.Write([]byte(`{"rayId":"r1","seq":1}`)))
+	assert.NoError(i.Write([]byte(`{"rayId":"r1","seq":2}`)))
+	assert.NoError(i.Write([]byte(`{"rayId":"r1","seq":1}`)))
+	assert.NoError(i.Close())
+
+	docs := f.received()
+	if assert.Len(docs, 2) {
+		assert.Equal(fakeDoc{Action: "create", Index: "logs", ID: "r1-1", Body: `{"rayId":"r1","seq":1}`}, docs[0])
+		assert.Equal("r1-2", docs[1].ID)
+	}
+	// Conflict is not rejection
+	assert.Len(dead.records, 0)
+}
+
+func TestDocumentIDBeforeEnrichment(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+	c, err := NewClient(Config{Addresses: []string{f.URL}, IndexFormat: "logs", ID: "hash"})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Same line, received twice from different senders at different time
+	e := NewEnricher(EnrichConfig{Timestamp: "@timestamp", Source: "source_ip"})
+	raw := []byte(`{"message": "hello"}`)
+	e.now = func() time.Time { return time.Unix(100, 0) }
+	first, err := e.Enrich(raw, &net.UDPAddr{IP: net.ParseIP("10.0.0.1")})
+	assert.NoError(err)
+	e.now = func() time.Time { return time.Unix(200, 0) }
+	second, err := e.Enrich(raw, &net.UDPAddr{IP: net.ParseIP("10.0.0.2")})
+	assert.NoError(err)
+	assert.NotEqual(string(first), string(second))
+
+	a, b := c.Document(raw, first), c.Document(raw, second)
+	assert.Equal(HashID([]byte(`{"message":"hello"}`)), a.ID)
+	assert.Equal(a.ID, b.ID)
+	assert.Equal(string(second), string(b.Body))
+
+	// Spooled and queued documents keep ID
+	decoded, err := DecodeDocument(EncodeDocument(b))
+	assert.NoError(err)
+	assert.Equal(b, decoded)
+}
+
+type collectDeadLetter struct {
+	records []Rejected
+}
+
+func (c *collectDeadLetter) Write(records []Rejected) error {
+	c.records = append(c.records, records...)
+	return nil
+}
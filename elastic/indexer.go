@@ -0,0 +1,335 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/mono83/dogrelay/spool"
+	"github.com/mono83/dogrelay/transport"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"sync"
+	"time"
+)
+
+// BulkConfig contains batching settings of Indexer
+type BulkConfig struct {
+	MaxCount   int           // Max documents in single bulk request
+	MaxBytes   int           // Max bytes of documents in single bulk request
+	MaxLatency time.Duration // Max time document waits for batch to fill
+	Workers    int           // Amount of concurrent bulk requests
+	MaxRetries int           // Retries of failed request or document
+	Backoff    time.Duration // Delay before first retry, doubled on every next one
+	MaxBackoff time.Duration // Upper limit for delay between retries
+	Timeout    time.Duration // Single bulk request timeout
+	Create     bool          // Use create operation, required by data streams and idempotent with IDs
+}
+
+// DefaultBulkConfig contains default batching settings
+var DefaultBulkConfig = BulkConfig{
+	MaxCount:   1000,
+	MaxBytes:   5 << 20,
+	MaxLatency: time.Second,
+	Workers:    1,
+	MaxRetries: 3,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+	Timeout:    30 * time.Second,
+}
+
+// Indexer batches documents into bulk requests. Batch is sent when
+// it reaches max count or size, or when its first document waits for
+// max latency. Results of individual documents are checked, temporary
+// failures are retried with backoff and rejected documents are counted.
+// Documents, failed after all retries, are dropped or written to spool.
+type Indexer struct {
+	client  *Client
+	cfg     BulkConfig
+	log     xray.Ray
+	batches chan []Document
+	wg      sync.WaitGroup
+	sending sync.WaitGroup // Batches, taken but not handed to workers yet
+	spool   *spool.Spool
+	stop    chan struct{}
+
+	deadLetter DeadLetter
+	rejects    chan Rejected // Documents, rejected before indexing
+
+	m          sync.Mutex
+	batch      []Document
+	size       int
+	generation int
+	closed     bool
+}
+
+// NewIndexer builds new indexer over given client and starts workers.
+// Zero settings are taken from DefaultBulkConfig.
+func NewIndexer(c *Client, cfg BulkConfig) *Indexer {
+	if cfg.MaxCount <= 0 {
+		cfg.MaxCount = DefaultBulkConfig.MaxCount
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultBulkConfig.MaxBytes
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = DefaultBulkConfig.MaxLatency
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultBulkConfig.Workers
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBulkConfig.Backoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultBulkConfig.MaxBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultBulkConfig.Timeout
+	}
+
+	i := &Indexer{
+		client:  c,
+		cfg:     cfg,
+		log:     c.logger,
+		batches: make(chan []Document, cfg.Workers),
+	}
+	for w := 0; w < cfg.Workers; w++ {
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+			var buf bytes.Buffer
+			for batch := range i.batches {
+				i.process(batch, &buf)
+			}
+		}()
+	}
+	return i
+}
+
+// Write adds raw JSON document to index, chosen by client router, with
+// ID, built by client ID function. Document is compacted into single
+// line, invalid JSON is rejected.
+func (i *Indexer) Write(b []byte) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		i.log.Inc("invalid")
+		return err
+	}
+	i.Add(i.client.Document(buf.Bytes(), buf.Bytes()))
+	return nil
+}
+
+// Add adds document to current batch. It blocks when all workers are
+// busy and their queue is full. Full batch is taken under lock and
+// handed to workers after unlocking, so other writers are not blocked
+// meanwhile.
+func (i *Indexer) Add(doc Document) {
+	i.m.Lock()
+	if i.closed {
+		i.m.Unlock()
+		i.log.Inc("dropped", args.Type("closed"))
+		return
+	}
+	if len(i.batch) == 0 {
+		generation := i.generation
+		time.AfterFunc(i.cfg.MaxLatency, func() { i.flush(generation) })
+	}
+	i.batch = append(i.batch, doc)
+	i.size += len(doc.Body)
+
+	var batch []Document
+	if len(i.batch) >= i.cfg.MaxCount || i.size >= i.cfg.MaxBytes {
+		batch = i.take()
+	}
+	i.m.Unlock()
+	i.dispatch(batch)
+}
+
+// flush sends current batch, if it is still of given generation
+func (i *Indexer) flush(generation int) {
+	i.m.Lock()
+	var batch []Document
+	if i.generation == generation && len(i.batch) > 0 && !i.closed {
+		batch = i.take()
+	}
+	i.m.Unlock()
+	i.dispatch(batch)
+}
+
+// take returns current batch and starts new one, must be invoked
+// under lock
+func (i *Indexer) take() []Document {
+	batch := i.batch
+	i.batch = nil
+	i.size = 0
+	i.generation++
+	i.sending.Add(1)
+	return batch
+}
+
+// dispatch hands batch, returned by take, to workers
+func (i *Indexer) dispatch(batch []Document) {
+	if batch == nil {
+		return
+	}
+	i.batches <- batch
+	i.sending.Done()
+}
+
+// Close sends remaining documents and waits until workers finish
+func (i *Indexer) Close() error {
+	i.m.Lock()
+	if i.closed {
+		i.m.Unlock()
+		return nil
+	}
+	var batch []Document
+	if len(i.batch) > 0 {
+		batch = i.take()
+	}
+	i.closed = true
+	if i.stop != nil {
+		close(i.stop)
+	}
+	if i.rejects != nil {
+		close(i.rejects)
+	}
+	i.m.Unlock()
+
+	i.dispatch(batch)
+	i.sending.Wait()
+	close(i.batches)
+	i.wg.Wait()
+	return nil
+}
+
+// process sends batch, retrying failed documents
+func (i *Indexer) process(batch []Document, buf *bytes.Buffer) {
+	for attempt := 0; len(batch) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > i.cfg.MaxRetries {
+				i.log.Error("Unable to index :count documents after retries", args.Count(len(batch)))
+				i.toSpool(batch)
+				return
+			}
+			i.log.Increment("retry", int64(len(batch)))
+			time.Sleep(transport.Backoff(attempt, i.cfg.Backoff, i.cfg.MaxBackoff))
+		}
+		batch, _ = i.send(batch, buf)
+	}
+}
+
+// send sends single bulk request and returns documents to retry. Temporary
+// failure of whole request is returned as error along with all documents.
+func (i *Indexer) send(batch []Document, buf *bytes.Buffer) ([]Document, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), i.cfg.Timeout)
+	defer cancel()
+
+	before := time.Now()
+	action := "index"
+	if i.cfg.Create {
+		action = "create"
+	}
+	items, err := i.client.bulk(ctx, action, batch, buf)
+	i.log.Duration("bulk.latency", time.Now().Sub(before))
+	i.log.Inc("bulk.requests")
+	i.log.Increment("bulk.docs", int64(len(batch)))
+	i.log.Increment("bulk.bytes", int64(buf.Len()))
+	if err != nil {
+		i.log.Error("Bulk request with :count documents failed - :err", args.Count(len(batch)), args.Error{Err: err})
+		i.log.Inc("error", args.Type(transport.ErrorType(err)))
+		if transport.IsTemporary(err) {
+			return batch, err
+		}
+		i.log.Increment("dropped", int64(len(batch)), args.Type("request"))
+		rejected := make([]Rejected, len(batch))
+		for j, doc := range batch {
+			rejected[j] = Rejected{Document: doc, Time: before, Reason: "request", Message: err.Error()}
+		}
+		i.Reject(rejected)
+		return nil, nil
+	}
+
+	var retry []Document
+	var rejected []Rejected
+	indexed, duplicates := 0, 0
+	for j, item := range items {
+		switch {
+		case item.Status >= 200 && item.Status < 300:
+			indexed++
+		case item.Status == 409 && i.cfg.Create:
+			// Document with same ID is already indexed by previous
+			// attempt or replay
+			duplicates++
+		case item.Temporary():
+			retry = append(retry, batch[j])
+		default:
+			r := Rejected{Document: batch[j], Time: before, Reason: "unknown"}
+			if item.Error != nil {
+				r.Reason, r.Message = item.Error.Type, item.Error.Reason
+				i.log.Error("Document rejected by :name - :err", args.Name(batch[j].Index), args.Error{Err: item.Error})
+			}
+			i.log.Inc("rejected", args.Type(r.Reason))
+			rejected = append(rejected, r)
+		}
+	}
+	i.log.Increment("indexed", int64(indexed))
+	if duplicates > 0 {
+		i.log.Increment("duplicate", int64(duplicates))
+	}
+	i.Reject(rejected)
+	return retry, nil
+}
+
+// DeadLetter makes indexer write rejected documents into given dead letter
+// queue and starts writer of documents, queued by QueueReject. Must be
+// invoked before first document is added.
+func (i *Indexer) DeadLetter(d DeadLetter) {
+	i.deadLetter = d
+	i.rejects = make(chan Rejected, i.cfg.MaxCount)
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		for r := range i.rejects {
+			// Taking all queued documents into single batch
+			batch := []Rejected{r}
+			for len(batch) < i.cfg.MaxCount && len(i.rejects) > 0 {
+				batch = append(batch, <-i.rejects)
+			}
+			i.Reject(batch)
+		}
+	}()
+}
+
+// QueueReject places document, rejected before indexing, into bounded
+// queue of dead letter writer. It never blocks, documents are dropped
+// and counted when queue is full.
+func (i *Indexer) QueueReject(r Rejected) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if i.rejects == nil || i.closed {
+		return
+	}
+	select {
+	case i.rejects <- r:
+	default:
+		i.log.Inc("dlq.dropped", args.Type("queue"))
+	}
+}
+
+// Reject writes rejected documents into dead letter queue, if any. Used
+// by indexer itself, documents, rejected before indexing, go through
+// QueueReject.
+func (i *Indexer) Reject(rejected []Rejected) {
+	if i.deadLetter == nil || len(rejected) == 0 {
+		return
+	}
+	if err := i.deadLetter.Write(rejected); err != nil {
+		i.log.Error("Unable to write :count documents to dead letter queue - :err", args.Count(len(rejected)), args.Error{Err: err})
+		i.log.Increment("dlq.dropped", int64(len(rejected)))
+		return
+	}
+	for _, r := range rejected {
+		i.log.Inc("dlq.written", args.Type(r.Reason))
+	}
+}
@@ -0,0 +1,210 @@
+package elastic
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mono83/dogrelay/spool"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestClient(t testing.TB, f *fakeElastic) *Client {
+	c, err := NewClient(Config{Addresses: []string{f.URL}, IndexFormat: "logs-2006.01.02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestIndexerBatching(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+
+	// Batch by count
+	i := NewIndexer(newTestClient(t, f), BulkConfig{MaxCount: 2, MaxLatency: time.Hour})
+	for j := 0; j < 4; j++ {
+		assert.NoError(i.Write([]byte(fmt.Sprintf("{\n  \"n\": %d\n}", j))))
+	}
+	assert.Error(i.Write([]byte("not json")))
+	assert.NoError(i.Close())
+	assert.Equal(2, f.bulks)
+	docs := f.received()
+	if assert.Len(docs, 4) {
+		assert.Equal("index", docs[0].Action)
+		assert.Equal(time.Now().Format("logs-2006.01.02"), docs[0].Index)
+		assert.Equal(`{"n":0}`, docs[0].Body)
+	}
+
+	// Batch by bytes
+	f.bulks = 0
+	i = NewIndexer(newTestClient(t, f), BulkConfig{MaxBytes: 10, MaxLatency: time.Hour})
+	for j := 0; j < 3; j++ {
+		i.Add(Document{Index: "x", Body: []byte(`{"field":1}`)})
+	}
+	assert.NoError(i.Close())
+	assert.Equal(3, f.bulks)
+
+	// Batch by latency, with create operation
+	f.bulks = 0
+	i = NewIndexer(newTestClient(t, f), BulkConfig{MaxLatency: 10 * time.Millisecond, Create: true})
+	i.Add(Document{Index: "x", Body: []byte(`{}`)})
+	time.Sleep(100 * time.Millisecond)
+	f.m.Lock()
+	assert.Equal(1, f.bulks)
+	f.m.Unlock()
+	assert.NoError(i.Close())
+	docs = f.received()
+	assert.Equal("create", docs[len(docs)-1].Action)
+}
+
+func TestIndexerRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+	f.failRequests = 1
+	attempts := map[string]int{}
+	f.item = func(doc fakeDoc) (int, string) {
+		attempts[doc.Body]++
+		switch {
+		case doc.Body == `{"n":"throttled"}` && attempts[doc.Body] == 1:
+			return 429, "es_rejected_execution_exception"
+		case doc.Body == `{"n":"conflict"}`:
+			return 400, "mapper_parsing_exception"
+		}
+		return 201, ""
+	}
+
+	i := NewIndexer(newTestClient(t, f), BulkConfig{MaxRetries: 2, Backoff: time.Millisecond, MaxLatency: time.Hour})
+	i.Add(Document{Index: "x", Body: []byte(`{"n":"ok"}`)})
+	i.Add(Document{Index: "x", Body: []byte(`{"n":"throttled"}`)})
+	i.Add(Document{Index: "x", Body: []byte(`{"n":"conflict"}`)})
+	assert.NoError(i.Close())
+
+	// Failed request, then batch with throttled document, then its retry
+	assert.Equal(3, f.bulks)
+	assert.Equal(map[string]int{`{"n":"ok"}`: 1, `{"n":"throttled"}`: 2, `{"n":"conflict"}`: 1}, attempts)
+	assert.Len(f.received(), 2)
+
+	// Retries are limited
+	f.failRequests = 10
+	f.bulks = 0
+	i = NewIndexer(newTestClient(t, f), BulkConfig{MaxRetries: 2, Backoff: time.Millisecond, MaxLatency: time.Hour})
+	i.Add(Document{Index: "x", Body: []byte(`{}`)})
+	assert.NoError(i.Close())
+	assert.Equal(3, f.bulks)
+}
+
+func TestIndexerSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	s, err := spool.Open(dir, 0, 0)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Cluster is down, documents go to spool
+	f.failRequests = 100
+	i := NewIndexer(newTestClient(t, f), BulkConfig{MaxRetries: 1, Backoff: time.Millisecond, MaxLatency: time.Hour})
+	i.Spool(s, time.Hour)
+	i.Add(Document{Index: "x", ID: "1", Body: []byte(`{"n":1}`)})
+	i.Add(Document{Index: "y", Body: []byte(`{"n":2}`)})
+	assert.NoError(i.Close())
+	assert.Len(f.received(), 0)
+	assert.NoError(s.Close())
+
+	// Spool survives restart and is replayed after recovery
+	s, err = spool.Open(dir, 0, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(s.Size() > 0)
+	f.failRequests = 0
+	i = NewIndexer(newTestClient(t, f), BulkConfig{MaxCount: 1, MaxLatency: time.Hour})
+	i.Spool(s, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(i.Close())
+	assert.Equal(int64(0), s.Size())
+	docs := f.received()
+	if assert.Len(docs, 2) {
+		assert.Equal(fakeDoc{Action: "index", Index: "x", ID: "1", Body: `{"n":1}`}, docs[0])
+		assert.Equal(fakeDoc{Action: "index", Index: "y", Body: `{"n":2}`}, docs[1])
+	}
+}
+
+func TestIndexerReplayKeepsSegment(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	s, err := spool.Open(dir, 0, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Append(encodeDocuments([]Document{
+		{Index: "x", Body: []byte(`{"n":1}`)},
+		{Index: "x", Body: []byte(`{"n":2}`)},
+	})...))
+	size := s.Size()
+	assert.NoError(s.Close())
+
+	// Spool is full, so throttled document cannot be spooled again
+	s, err = spool.Open(dir, size, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	throttled := true
+	f.item = func(doc fakeDoc) (int, string) {
+		if throttled && doc.Body == `{"n":2}` {
+			return 429, "es_rejected_execution_exception"
+		}
+		return 201, ""
+	}
+	i := NewIndexer(newTestClient(t, f), BulkConfig{MaxLatency: time.Hour})
+	i.spool = s
+	var buf bytes.Buffer
+	assert.False(i.replay(&buf))
+	assert.Equal(size, s.Size())
+	assert.Len(f.received(), 1)
+
+	// Segment is replayed again
+	throttled = false
+	assert.True(i.replay(&buf))
+	assert.Equal(int64(0), s.Size())
+	assert.Len(f.received(), 3)
+	assert.NoError(i.Close())
+}
+
+func BenchmarkIndexer(b *testing.B) {
+	f := newFakeElastic(b)
+	defer f.Close()
+
+	doc := []byte(`{"@timestamp":"2021-01-01T00:00:00Z","app":"api","message":"request processed in 12ms","level":"info"}`)
+	i := NewIndexer(newTestClient(b, f), BulkConfig{MaxCount: 1000, Workers: 2})
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		if err := i.Write(doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+	_ = i.Close()
+}
@@ -0,0 +1,221 @@
+package elastic
+
+import (
+	"encoding/json"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"strings"
+	"time"
+)
+
+// Router builds index names from pattern like logs-{app}-2006.01.02,
+// where fields in braces are replaced with sanitized document values
+// and the rest is Go time layout, applied to document time. Documents
+// without pattern fields go to fallback index.
+type Router struct {
+	parts     []routePart
+	fallback  string
+	timestamp string
+	maxSkew   time.Duration
+	log       xray.Ray
+}
+
+type routePart struct {
+	layout string // Go time layout, when field is empty
+	field  string
+}
+
+// NewRouter constructs new index router. Fallback is Go time layout too,
+// document time is taken from given timestamp field, empty to always use
+// arrival time.
+func NewRouter(pattern, fallback, timestamp string) *Router {
+	r := &Router{
+		fallback:  fallback,
+		timestamp: timestamp,
+		log:       xray.ROOT.Fork().WithLogger("elastic").WithMetricPrefix("elastic"),
+	}
+	for len(pattern) > 0 {
+		open := strings.IndexByte(pattern, '{')
+		closing := strings.IndexByte(pattern[open+1:], '}')
+		if open < 0 || closing < 0 {
+			r.parts = append(r.parts, routePart{layout: pattern})
+			break
+		}
+		if open > 0 {
+			r.parts = append(r.parts, routePart{layout: pattern[:open]})
+		}
+		r.parts = append(r.parts, routePart{field: pattern[open+1 : open+1+closing]})
+		pattern = pattern[open+closing+2:]
+	}
+	if len(r.fallback) == 0 {
+		// Pattern with fields replaced by "unknown"
+		var sb strings.Builder
+		for _, p := range r.parts {
+			if len(p.field) > 0 {
+				sb.WriteString("unknown")
+			} else {
+				sb.WriteString(p.layout)
+			}
+		}
+		r.fallback = sb.String()
+	}
+	return r
+}
+
+// SetMaxSkew configures max distance of document time from arrival time.
+// Documents with time beyond it, like misconfigured clocks or replayed
+// archives, are routed by arrival time. Zero disables the limit.
+func (r *Router) SetMaxSkew(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	r.maxSkew = d
+}
+
+// TimeBased returns true if index pattern contains Go time layout, so
+// documents go to different indices over time
+func TimeBased(pattern string) bool {
+	a := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	b := time.Date(2012, 11, 24, 15, 36, 47, 789000000, time.UTC)
+	for _, p := range NewRouter(pattern, "-", "").parts {
+		if len(p.field) == 0 && a.Format(p.layout) != b.Format(p.layout) {
+			return true
+		}
+	}
+	return false
+}
+
+// Index returns index name for given compact JSON document
+func (r *Router) Index(body []byte, now time.Time) string {
+	if len(r.timestamp) == 0 && len(r.parts) == 1 && len(r.parts[0].field) == 0 {
+		// Plain time pattern, nothing to read from document
+		return now.Format(r.parts[0].layout)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		r.log.Inc("index.fallback", args.Type("json"))
+		return now.Format(r.fallback)
+	}
+	t := r.time(fields, now)
+
+	var sb strings.Builder
+	for _, p := range r.parts {
+		if len(p.field) == 0 {
+			sb.WriteString(t.Format(p.layout))
+			continue
+		}
+		value := Sanitize(stringValue(lookup(fields, p.field)))
+		if len(value) == 0 {
+			r.log.Inc("index.fallback", args.Type("field"))
+			return t.Format(r.fallback)
+		}
+		sb.WriteString(value)
+	}
+	index := sb.String()
+	if !ValidIndex(index) {
+		r.log.Inc("index.fallback", args.Type("invalid"))
+		return t.Format(r.fallback)
+	}
+	return index
+}
+
+// time returns document time from timestamp field, or given arrival time
+// when there is no valid one within max skew
+func (r *Router) time(fields map[string]json.RawMessage, now time.Time) time.Time {
+	t, ok := r.parseTime(fields, now)
+	if !ok {
+		return now
+	}
+	if r.maxSkew > 0 && (t.Before(now.Add(-r.maxSkew)) || t.After(now.Add(r.maxSkew))) {
+		r.log.Inc("index.skew")
+		return now
+	}
+	return t
+}
+
+// parseTime reads document time from timestamp field, RFC 3339 string or
+// epoch milliseconds
+func (r *Router) parseTime(fields map[string]json.RawMessage, now time.Time) (time.Time, bool) {
+	raw := lookup(fields, r.timestamp)
+	if len(raw) == 0 {
+		return now, false
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return now, false
+	}
+	switch x := v.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, x); err == nil {
+			return t.In(now.Location()), true
+		}
+	case float64:
+		return time.Unix(0, int64(x)*int64(time.Millisecond)).In(now.Location()), true
+	}
+	return now, false
+}
+
+// lookup returns raw value of field, dots in name address nested objects
+func lookup(fields map[string]json.RawMessage, name string) json.RawMessage {
+	if len(name) == 0 {
+		return nil
+	}
+	if v, ok := fields[name]; ok {
+		return v
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(fields[name[:i]], &nested); err == nil && nested != nil {
+			if v := lookup(nested, name[i+1:]); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// stringValue returns string representation of raw string, number or
+// boolean JSON value, and empty string for other values
+func stringValue(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		_ = json.Unmarshal(raw, &s)
+		return s
+	case '{', '[', 'n':
+		return ""
+	}
+	return string(raw)
+}
+
+// Sanitize converts value into index name part: lowercases it and
+// replaces characters, not allowed in index names, with underscore
+func Sanitize(value string) string {
+	value = strings.ToLower(value)
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ' ', ',', '#', ':', '\t', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// ValidIndex returns true if given name is valid index name
+func ValidIndex(name string) bool {
+	if len(name) == 0 || len(name) > 255 || name == "." || name == ".." {
+		return false
+	}
+	switch name[0] {
+	case '-', '_', '+':
+		return false
+	}
+	return name == Sanitize(name)
+}
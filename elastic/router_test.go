@@ -0,0 +1,69 @@
+package elastic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	now := time.Date(2021, 3, 4, 23, 0, 0, 0, time.UTC)
+
+	r := NewRouter("logs-{app}-{kube.ns}-2006.01.02", "", "@timestamp")
+	for _, c := range []struct{ doc, index string }{
+		{`{"app":"API","kube":{"ns":"prod"}}`, "logs-api-prod-2021.03.04"},
+		{`{"app":"api","kube.ns":42}`, "logs-api-42-2021.03.04"},
+		{`{"app":"Web App/v2","kube":{"ns":"a:b"},"@timestamp":"2021-02-01T10:00:00Z"}`, "logs-web_app_v2-a_b-2021.02.01"},
+		{`{"app":"api","kube":{"ns":"prod"},"@timestamp":1609459200000}`, "logs-api-prod-2021.01.01"},
+		{`{"app":"api","kube":{"ns":"prod"},"@timestamp":"yesterday"}`, "logs-api-prod-2021.03.04"},
+		{`{"app":"api","@timestamp":"2021-02-01T10:00:00+03:00"}`, "logs-unknown-unknown-2021.02.01"},
+		{`{"app":null,"kube":{"ns":"prod"}}`, "logs-unknown-unknown-2021.03.04"},
+		{`{"app":{"name":"api"},"kube":{"ns":"prod"}}`, "logs-unknown-unknown-2021.03.04"},
+		{`not json`, "logs-unknown-unknown-2021.03.04"},
+	} {
+		assert.Equal(t, c.index, r.Index([]byte(c.doc), now), c.doc)
+	}
+
+	// Invalid names go to fallback
+	r = NewRouter("{app}-2006", "fallback-2006", "")
+	assert.Equal(t, "fallback-2021", r.Index([]byte(`{"app":"_internal"}`), now))
+	assert.Equal(t, "fallback-2021", r.Index([]byte(`{"app":"`+strings.Repeat("a", 300)+`"}`), now))
+	assert.Equal(t, "x-2021", r.Index([]byte(`{"app":"x"}`), now))
+
+	// Plain time pattern
+	assert.Equal(t, "logstash-2021.03.04", NewRouter("logstash-2006.01.02", "", "").Index([]byte(`{"app":"x"}`), now))
+}
+
+func TestRouterMaxSkew(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2021, 3, 4, 23, 0, 0, 0, time.UTC)
+
+	r := NewRouter("logs-2006.01.02", "", "@timestamp")
+	r.SetMaxSkew(48 * time.Hour)
+	assert.Equal("logs-2021.03.03", r.Index([]byte(`{"@timestamp":"2021-03-03T10:00:00Z"}`), now))
+	assert.Equal("logs-2021.03.04", r.Index([]byte(`{"@timestamp":"1970-01-01T00:00:00Z"}`), now))
+	assert.Equal("logs-2021.03.04", r.Index([]byte(`{"@timestamp":"2099-01-01T00:00:00Z"}`), now))
+	assert.Equal("logs-2021.03.04", r.Index([]byte(`{"@timestamp":0}`), now))
+
+	// No limit
+	r.SetMaxSkew(0)
+	assert.Equal("logs-1970.01.01", r.Index([]byte(`{"@timestamp":0}`), now))
+}
+
+func TestTimeBased(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(TimeBased("logstash-2006.01.02"))
+	assert.True(TimeBased("logs-{app}-2006"))
+	assert.False(TimeBased("logs-{app}-default"))
+	assert.False(TimeBased("logs"))
+}
+
+func TestValidIndex(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(ValidIndex("logs-api-2021.01.01"))
+	assert.True(ValidIndex(".internal"))
+	for _, name := range []string{"", ".", "..", "-logs", "_logs", "+logs", "Logs", "logs*", "a b", "a,b", "a#b", "a:b"} {
+		assert.False(ValidIndex(name), name)
+	}
+}
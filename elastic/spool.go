@@ -0,0 +1,177 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/mono83/dogrelay/spool"
+	"github.com/mono83/xray/args"
+	"time"
+)
+
+// EncodeDocument encodes document into record of spool or byte queue:
+// length prefixed index and ID followed by body
+func EncodeDocument(doc Document) []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen64+len(doc.Index)+len(doc.ID)+len(doc.Body))
+	var n [binary.MaxVarintLen64]byte
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(doc.Index)))]...)
+	b = append(b, doc.Index...)
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(doc.ID)))]...)
+	b = append(b, doc.ID...)
+	return append(b, doc.Body...)
+}
+
+// DecodeDocument decodes record, built by EncodeDocument
+func DecodeDocument(b []byte) (Document, error) {
+	var doc Document
+	var err error
+	if doc.Index, b, err = readString(b); err != nil {
+		return doc, err
+	}
+	if doc.ID, b, err = readString(b); err != nil {
+		return doc, err
+	}
+	doc.Body = b
+	return doc, nil
+}
+
+func readString(b []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, spool.ErrCorrupted
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], nil
+}
+
+// Spool makes indexer write documents, failed after all retries, into
+// given disk spool instead of dropping them. Spooled documents are
+// replayed with given interval, once cluster accepts requests again.
+// Must be invoked before first document is added.
+func (i *Indexer) Spool(s *spool.Spool, interval time.Duration) {
+	i.spool = s
+	i.stop = make(chan struct{})
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		var buf bytes.Buffer
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-i.stop:
+				return
+			case <-t.C:
+				// Stop is checked between segments, so Close does not
+				// wait until whole spool is replayed
+				for i.replay(&buf) && !i.stopped() {
+				}
+			}
+		}
+	}()
+}
+
+// stopped returns true when indexer is closed
+func (i *Indexer) stopped() bool {
+	select {
+	case <-i.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// toSpool writes documents into spool or drops them, if there is none
+func (i *Indexer) toSpool(docs []Document) {
+	if i.spool == nil {
+		i.log.Increment("dropped", int64(len(docs)), args.Type("retries"))
+		return
+	}
+	err := i.spool.Append(encodeDocuments(docs)...)
+	if err == spool.ErrFull {
+		i.log.Error("Spool is full, dropping :count documents", args.Count(len(docs)))
+		i.log.Increment("dropped", int64(len(docs)), args.Type("spool_full"))
+		return
+	} else if err != nil {
+		i.log.Error("Unable to spool :count documents - :err", args.Count(len(docs)), args.Error{Err: err})
+		i.log.Inc("error", args.Type("spool"))
+		i.log.Increment("dropped", int64(len(docs)), args.Type("spool"))
+		return
+	}
+	i.log.Increment("spool.written", int64(len(docs)))
+	i.log.Gauge("spool.size", i.spool.Size())
+}
+
+// encodeDocuments encodes documents into spool records
+func encodeDocuments(docs []Document) [][]byte {
+	records := make([][]byte, len(docs))
+	for j, doc := range docs {
+		records[j] = EncodeDocument(doc)
+	}
+	return records
+}
+
+// replay sends oldest spool segment and returns true if it was processed
+// and next one may be taken. Segment is kept, when cluster is still
+// unavailable or failed documents cannot be spooled again.
+func (i *Indexer) replay(buf *bytes.Buffer) bool {
+	id, records, err := i.spool.Read()
+	switch err {
+	case nil:
+	case spool.ErrEmpty:
+		return false
+	case spool.ErrCorrupted:
+		i.log.Error("Spool segment :id is corrupted, replaying :count valid documents", args.ID64(id), args.Count(len(records)))
+		i.log.Inc("spool.corrupted")
+	default:
+		i.log.Error("Unable to read spool - :err", args.Error{Err: err})
+		i.log.Inc("error", args.Type("spool"))
+		return false
+	}
+
+	docs := make([]Document, 0, len(records))
+	for _, r := range records {
+		doc, err := DecodeDocument(r)
+		if err != nil {
+			i.log.Inc("spool.corrupted")
+			continue
+		}
+		docs = append(docs, doc)
+	}
+
+	var failed []Document
+	for sent := 0; sent < len(docs); {
+		chunk := docs[sent:]
+		if len(chunk) > i.cfg.MaxCount {
+			chunk = chunk[:i.cfg.MaxCount]
+		}
+		retry, err := i.send(chunk, buf)
+		if err != nil && sent == 0 {
+			// Nothing sent yet, segment stays as is
+			return false
+		}
+		i.log.Increment("spool.replayed", int64(len(chunk)-len(retry)))
+		failed = append(failed, retry...)
+		sent += len(chunk)
+		if err != nil {
+			failed = append(failed, docs[sent:]...)
+			break
+		}
+	}
+
+	if len(failed) > 0 {
+		// Segment is removed only after failed documents are safe, otherwise
+		// it is replayed again and sent documents are indexed twice
+		if err := i.spool.Append(encodeDocuments(failed)...); err != nil {
+			i.log.Error("Unable to spool :count documents again, keeping segment :id - :err", args.Count(len(failed)), args.ID64(id), args.Error{Err: err})
+			i.log.Inc("error", args.Type("spool"))
+			return false
+		}
+		i.log.Increment("spool.written", int64(len(failed)))
+	}
+	if err := i.spool.Remove(id); err != nil {
+		i.log.Error("Unable to remove spool segment :id - :err", args.ID64(id), args.Error{Err: err})
+		i.log.Inc("error", args.Type("spool"))
+		return false
+	}
+	i.log.Gauge("spool.size", i.spool.Size())
+	return len(failed) == 0
+}
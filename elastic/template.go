@@ -1,202 +1,275 @@
 package elastic
 
-var indexTemplateString = `{
-    "index_patterns": [
-      "logstash-*"
-    ],
-	"template":{
-		"mappings" : {
-		  "_default_" : {
-			"dynamic_templates" : [ {
-			  "string_fields" : {
-				"mapping" : {
-				  "index" : "analyzed",
-				  "omit_norms" : true,
-				  "fielddata" : {
-					"format" : "disabled"
-				  },
-				  "type" : "string",
-				  "fields" : {
-					"raw" : {
-					  "index" : "not_analyzed",
-					  "ignore_above" : 256,
-					  "doc_values" : true,
-					  "type" : "string"
-					}
-				  }
-				},
-				"match_mapping_type" : "string",
-				"match" : "*"
-			  }
-			}, {
-			  "float_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "float"
-				},
-				"match_mapping_type" : "float",
-				"match" : "*"
-			  }
-			}, {
-			  "double_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "double"
-				},
-			   "match_mapping_type" : "double",
-				"match" : "*"
-			  }
-			}, {
-			  "byte_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "byte"
-				},
-				"match_mapping_type" : "byte",
-				"match" : "*"
-			  }
-			}, {
-			  "short_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "short"
-				},
-				"match_mapping_type" : "short",
-				"match" : "*"
-			  }
-			}, {
-			  "integer_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "integer"
-				},
-				"match_mapping_type" : "integer",
-				"match" : "*"
-			  }
-			}, {
-			  "long_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "long"
-				},
-				"match_mapping_type" : "long",
-				"match" : "*"
-			  }
-			}, {
-			  "date_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "date"
-				},
-				"match_mapping_type" : "date",
-				"match" : "*"
-			  }
-			}, {
-			  "geo_point_fields" : {
-				"mapping" : {
-				  "doc_values" : true,
-				  "type" : "geo_point"
-				},
-				"match_mapping_type" : "geo_point",
-				"match" : "*"
-			  }
-			} ],
-			"properties" : {
-			  "@timestamp" : {
-				"doc_values" : true,
-				"type" : "date"
-			  },
-			  "geoip" : {
-				"dynamic" : true,
-				"properties" : {
-				  "location" : {
-					"doc_values" : true,
-					"type" : "geo_point"
-				  },
-				  "longitude" : {
-					"doc_values" : true,
-					"type" : "float"
-				  },
-				  "latitude" : {
-					"doc_values" : true,
-					"type" : "float"
-				  },
-				  "ip" : {
-					"doc_values" : true,
-					"type" : "ip"
-				  }
-				},
-				"type" : "object"
-			  },
-			  "@version" : {
-				"index" : "not_analyzed",
-				"doc_values" : true,
-				"type" : "string"
-			  },
-			  "gateId": {
-				"type": "integer"
-			  },
-			  "from": {
-				"type": "string"
-			  },
-			  "to": {
-				"type": "string"
-			  },
-			  "value": {
-				"type": "string"
-			  },
-			  "ranges": {
-				"type": "string"
-			  },
-			  "fromTime": {
-				"format": "yyyy/MM/dd HH:mm:ss||yyyy/MM/dd||epoch_millis",
-				"type": "date"
-			  },
-			  "tillTime": {
-				"format": "yyyy/MM/dd HH:mm:ss||yyyy/MM/dd||epoch_millis",
-				"type": "date"
-			  },
-			  "id": {
-				"type": "string"
-			  },
-			  "bank": {
-				  "fielddata": {
-					  "format": "disabled"
-				  },
-				  "fields": {
-					  "raw": {
-						  "ignore_above": 256,
-						  "index": "not_analyzed",
-						  "type": "string"
-					  }
-				  },
-				  "norms": {
-					  "enabled": false
-				  },
-				  "type": "string"
-			  },
-			  "c": {
-				  "fielddata": {
-					  "format": "disabled"
-				  },
-				  "fields": {
-					  "raw": {
-						  "ignore_above": 256,
-						  "index": "not_analyzed",
-						  "type": "string"
-					  }
-				  },
-				  "norms": {
-					  "enabled": false
-				  },
-				  "type": "string"
-			  }
-			},
-			"_all" : {
-			  "enabled" : true,
-			  "omit_norms" : true
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TemplateConfig contains settings of composable index template
+type TemplateConfig struct {
+	Name       string   // Index template name, also prefix of component templates
+	Patterns   []string // Index patterns, template is applied to
+	Priority   int      // Template priority, higher wins on overlapping patterns, negative for default
+	DataStream bool     // Write into data stream instead of regular indices
+	Policy     string   // Lifecycle policy name, empty for none
+	ISM        bool     // Policy is OpenSearch ISM policy instead of ILM one
+	File       string   // User supplied index template JSON, replaces built in one
+}
+
+// DefaultTemplateConfig contains default index template settings
+var DefaultTemplateConfig = TemplateConfig{
+	Name:     "logstash",
+	Patterns: []string{"logstash-*"},
+	Priority: 200,
+}
+
+// mappingsTemplate is built in component template with mappings for logs
+var mappingsTemplate = `{
+  "template": {
+    "mappings": {
+      "dynamic_templates": [
+        {
+          "strings": {
+            "match_mapping_type": "string",
+            "mapping": {
+              "type": "text",
+              "norms": false,
+              "fields": {
+                "raw": {"type": "keyword", "ignore_above": 256}
+              }
+            }
+          }
+        }
+      ],
+      "properties": {
+        "@timestamp": {"type": "date"},
+        "@version": {"type": "keyword"},
+        "geoip": {
+          "dynamic": true,
+          "properties": {
+            "location": {"type": "geo_point"},
+            "longitude": {"type": "float"},
+            "latitude": {"type": "float"},
+            "ip": {"type": "ip"}
+          }
+        },
+        "gateId": {"type": "integer"},
+        "fromTime": {"type": "date", "format": "yyyy/MM/dd HH:mm:ss||yyyy/MM/dd||epoch_millis"},
+        "tillTime": {"type": "date", "format": "yyyy/MM/dd HH:mm:ss||yyyy/MM/dd||epoch_millis"}
+      }
+    }
+  }
+}`
+
+// componentNames returns names of mappings and settings component templates
+func (t TemplateConfig) componentNames() (string, string) {
+	return t.Name + "-mappings", t.Name + "-settings"
+}
+
+// settingsTemplate builds settings component template
+func (t TemplateConfig) settingsTemplate() ([]byte, error) {
+	settings := map[string]interface{}{}
+	if len(t.Policy) > 0 && !t.ISM {
+		settings["index.lifecycle.name"] = t.Policy
+	}
+	return json.Marshal(map[string]interface{}{"template": map[string]interface{}{"settings": settings}})
+}
+
+// indexTemplate builds index template or reads it from user supplied file
+func (t TemplateConfig) indexTemplate() ([]byte, error) {
+	if len(t.File) > 0 {
+		bts, err := ioutil.ReadFile(t.File)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(bts) {
+			return nil, fmt.Errorf("index template file %s is not valid JSON", t.File)
+		}
+		return bts, nil
+	}
+
+	mappings, settings := t.componentNames()
+	template := map[string]interface{}{
+		"index_patterns": t.Patterns,
+		"composed_of":    []string{mappings, settings},
+		"priority":       t.Priority,
+		"_meta":          map[string]string{"managed_by": "dogrelay"},
+	}
+	if t.DataStream {
+		template["data_stream"] = map[string]interface{}{}
+	}
+	return json.Marshal(template)
+}
+
+// EnsureTemplate creates or updates component templates and composable
+// index template, built from given settings, and attaches lifecycle policy.
+// Requires Elasticsearch 7.8+ or OpenSearch 1.0+.
+func (c *Client) EnsureTemplate(cfg TemplateConfig) error {
+	if len(cfg.Name) == 0 {
+		cfg.Name = DefaultTemplateConfig.Name
+	}
+	if len(cfg.Patterns) == 0 {
+		cfg.Patterns = DefaultTemplateConfig.Patterns
+	}
+	if cfg.Priority < 0 {
+		cfg.Priority = DefaultTemplateConfig.Priority
+	}
+	ctx := context.Background()
+
+	mappings, settings := cfg.componentNames()
+	if err := c.do(ctx, esapi.ClusterPutComponentTemplateRequest{
+		Name: mappings,
+		Body: strings.NewReader(mappingsTemplate),
+	}); err != nil {
+		return fmt.Errorf("unable to put component template %s: %w", mappings, err)
+	}
+	body, err := cfg.settingsTemplate()
+	if err != nil {
+		return err
+	}
+	if err := c.do(ctx, esapi.ClusterPutComponentTemplateRequest{
+		Name: settings,
+		Body: bytes.NewReader(body),
+	}); err != nil {
+		return fmt.Errorf("unable to put component template %s: %w", settings, err)
+	}
+
+	body, err = cfg.indexTemplate()
+	if err != nil {
+		return err
+	}
+	if err := c.do(ctx, esapi.IndicesPutIndexTemplateRequest{
+		Name: cfg.Name,
+		Body: bytes.NewReader(body),
+	}); err != nil {
+		return fmt.Errorf("unable to put index template %s: %w", cfg.Name, err)
+	}
+	xray.BOOT.Info("Index template :name created", args.Name(cfg.Name))
+
+	if len(cfg.Policy) > 0 && cfg.ISM {
+		if err := c.attachISMPolicy(ctx, cfg.Policy, cfg.Patterns, cfg.Priority); err != nil {
+			return fmt.Errorf("unable to attach ISM policy %s: %w", cfg.Policy, err)
+		}
+		xray.BOOT.Info("ISM policy :name attached", args.Name(cfg.Policy))
+	}
+	return nil
+}
+
+// attachISMPolicy adds ISM template with given index patterns to existing
+// OpenSearch policy, so new indices are managed by it. ISM has no index
+// setting for this, unlike ILM. Other ISM templates of policy are kept,
+// only given patterns are moved from them into new one.
+func (c *Client) attachISMPolicy(ctx context.Context, policy string, patterns []string, priority int) error {
+	path := "/_plugins/_ism/policies/" + url.PathEscape(policy)
+	var current struct {
+		SeqNo       int64                  `json:"_seq_no"`
+		PrimaryTerm int64                  `json:"_primary_term"`
+		Policy      map[string]interface{} `json:"policy"`
+	}
+	if err := c.perform(ctx, "GET", path, nil, &current); err != nil {
+		return err
+	}
+	if current.Policy == nil {
+		return fmt.Errorf("policy %s not found", policy)
+	}
+	current.Policy["ism_template"] = mergeISMTemplates(current.Policy["ism_template"], patterns, priority)
+	body, err := json.Marshal(map[string]interface{}{"policy": current.Policy})
+	if err != nil {
+		return err
+	}
+	path += fmt.Sprintf("?if_seq_no=%d&if_primary_term=%d", current.SeqNo, current.PrimaryTerm)
+	return c.perform(ctx, "PUT", path, body, nil)
+}
+
+// mergeISMTemplates removes given patterns from existing ISM templates,
+// which is single object or list, and appends template with them
+func mergeISMTemplates(existing interface{}, patterns []string, priority int) []interface{} {
+	var list []interface{}
+	switch x := existing.(type) {
+	case []interface{}:
+		list = x
+	case map[string]interface{}:
+		list = []interface{}{x}
+	}
+
+	own := map[string]bool{}
+	for _, p := range patterns {
+		own[p] = true
+	}
+	var result []interface{}
+	for _, item := range list {
+		t, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		current, _ := t["index_patterns"].([]interface{})
+		var kept []interface{}
+		for _, p := range current {
+			if s, ok := p.(string); !ok || !own[s] {
+				kept = append(kept, p)
 			}
-		  }
 		}
+		if len(kept) == 0 {
+			continue
+		}
+		t["index_patterns"] = kept
+		result = append(result, t)
 	}
-}`
+	return append(result, map[string]interface{}{"index_patterns": patterns, "priority": priority})
+}
+
+// do executes API request, converting error response into error
+func (c *Client) do(ctx context.Context, req esapi.Request) error {
+	res, err := req.Do(ctx, c.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return responseError(res)
+}
+
+// perform executes raw request to API, not covered by esapi, and decodes
+// response into given value, if it is not nil
+func (c *Client) perform(ctx context.Context, method, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpRes, err := c.client.Perform(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res := &esapi.Response{StatusCode: httpRes.StatusCode, Header: httpRes.Header, Body: httpRes.Body}
+	defer res.Body.Close()
+	if err := responseError(res); err != nil {
+		return err
+	}
+	if v != nil {
+		return json.NewDecoder(res.Body).Decode(v)
+	}
+	return nil
+}
+
+// responseError returns error for non 2xx response, built from error
+// reason, returned by Elasticsearch, or from response status
+func responseError(res *esapi.Response) error {
+	if !res.IsError() {
+		return nil
+	}
+	bts, _ := ioutil.ReadAll(res.Body)
+	var e esErrorResponse
+	if err := json.Unmarshal(bts, &e); err == nil && len(e.Error.Reason) > 0 {
+		return fmt.Errorf("%s: %w", res.Status(), e.Error)
+	}
+	return fmt.Errorf("%s: %s", res.Status(), strings.TrimSpace(string(bts)))
+}
@@ -0,0 +1,77 @@
+package elastic
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeElastic(t)
+	defer f.Close()
+	c := newTestClient(t, f)
+
+	// Data stream with ILM policy
+	assert.NoError(c.EnsureTemplate(TemplateConfig{Name: "logs", Patterns: []string{"logs-*"}, Priority: 100, DataStream: true, Policy: "30d"}))
+	assert.Equal([]string{
+		"PUT /_component_template/logs-mappings",
+		"PUT /_component_template/logs-settings",
+		"PUT /_index_template/logs",
+	}, f.requests)
+	assert.True(json.Valid([]byte(f.bodies["PUT /_component_template/logs-mappings"])))
+	assert.JSONEq(`{"template":{"settings":{"index.lifecycle.name":"30d"}}}`, f.bodies["PUT /_component_template/logs-settings"])
+	assert.JSONEq(
+		`{"index_patterns":["logs-*"],"composed_of":["logs-mappings","logs-settings"],"priority":100,"data_stream":{},"_meta":{"managed_by":"dogrelay"}}`,
+		f.bodies["PUT /_index_template/logs"],
+	)
+
+	// ISM policy is attached through policy ISM template
+	f.requests = nil
+	f.responses["GET /_plugins/_ism/policies/30d"] = fakeResponse{
+		Status: 200,
+		Body:   `{"_id":"30d","_seq_no":7,"_primary_term":1,"policy":{"default_state":"hot","states":[],"ism_template":[{"index_patterns":["audit-*","logs-*"],"priority":50},{"index_patterns":["logs-*"],"priority":10}]}}`,
+	}
+	assert.NoError(c.EnsureTemplate(TemplateConfig{Patterns: []string{"logs-*"}, Policy: "30d", ISM: true}))
+	assert.Equal([]string{
+		"PUT /_component_template/logstash-mappings",
+		"PUT /_component_template/logstash-settings",
+		"PUT /_index_template/logstash",
+		"GET /_plugins/_ism/policies/30d",
+		"PUT /_plugins/_ism/policies/30d",
+	}, f.requests)
+	assert.JSONEq(`{"template":{"settings":{}}}`, f.bodies["PUT /_component_template/logstash-settings"])
+	assert.Contains(f.bodies["PUT /_index_template/logstash"], `"priority":0`)
+	assert.JSONEq(
+		`{"policy":{"default_state":"hot","states":[],"ism_template":[{"index_patterns":["audit-*"],"priority":50},{"index_patterns":["logs-*"],"priority":0}]}}`,
+		f.bodies["PUT /_plugins/_ism/policies/30d"],
+	)
+
+	// User supplied template
+	dir, err := ioutil.TempDir("", "template")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "template.json")
+	assert.NoError(ioutil.WriteFile(name, []byte(`{"index_patterns":["custom-*"]}`), 0644))
+	assert.NoError(c.EnsureTemplate(TemplateConfig{Name: "custom", File: name}))
+	assert.Equal(`{"index_patterns":["custom-*"]}`, f.bodies["PUT /_index_template/custom"])
+
+	assert.NoError(ioutil.WriteFile(name, []byte(`{"index_patterns"`), 0644))
+	assert.Error(c.EnsureTemplate(TemplateConfig{Name: "custom", File: name}))
+
+	// Errors are returned
+	f.responses["PUT /_index_template/broken"] = fakeResponse{
+		Status: 400,
+		Body:   `{"error":{"type":"illegal_argument_exception","reason":"unknown setting"},"status":400}`,
+	}
+	err = c.EnsureTemplate(TemplateConfig{Name: "broken"})
+	if assert.Error(err) {
+		assert.Equal("unable to put index template broken: 400 Bad Request: unknown setting", err.Error())
+	}
+}
@@ -1,12 +1,21 @@
 module github.com/mono83/dogrelay
 
-go 1.13
+go 1.18
 
 require (
 	github.com/elastic/go-elasticsearch/v8 v8.0.0-alpha
+	github.com/golang/snappy v0.0.4
 	github.com/mono83/udpwriter v1.0.2
 	github.com/mono83/validate v1.0.4
 	github.com/mono83/xray v1.1.2
 	github.com/spf13/cobra v1.3.0
 	github.com/stretchr/testify v1.7.0
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/elastic/elastic-transport-go/v8 v8.0.0-alpha // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+)
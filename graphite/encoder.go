@@ -0,0 +1,207 @@
+package graphite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/mono83/dogrelay/metrics"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tag encoding modes
+const (
+	TagsNative = "tags" // Graphite 1.1 tags, like cpu;host=a
+	TagsPath   = "path" // Tags folded into path using template
+)
+
+// DefaultTemplate folds tag values into path after metric name
+const DefaultTemplate = "{metric}.{tags}"
+
+// Encoder converts metrics events into Graphite paths
+type Encoder struct {
+	// Tags is tags encoding mode, TagsNative or TagsPath. Empty mode
+	// means TagsNative.
+	Tags string
+
+	// Template is dotted path template, used in TagsPath mode. {metric}
+	// is replaced with metric name, {name} with value of tag name and
+	// {tags} with values of all tags, not used explicitly, ordered by
+	// tag name. Empty segments are omitted.
+	Template string
+
+	// Pickle enables pickle protocol instead of plaintext one
+	Pickle bool
+}
+
+// Validate checks encoder configuration
+func (enc Encoder) Validate() error {
+	switch enc.Tags {
+	case "", TagsNative, TagsPath:
+	default:
+		return fmt.Errorf("unsupported Graphite tags mode %q", enc.Tags)
+	}
+	if enc.Tags == TagsPath && len(enc.Template) > 0 && !strings.Contains(enc.Template, "{metric}") {
+		return fmt.Errorf("Graphite template %q does not contain {metric}", enc.Template)
+	}
+	return nil
+}
+
+// Path returns Graphite path of given event
+func (enc Encoder) Path(e metrics.Event) string {
+	if enc.Tags == TagsPath {
+		return enc.foldedPath(e)
+	}
+
+	var b strings.Builder
+	b.WriteString(sanitize(e.Metric, false))
+	params := append([]string(nil), e.Params...)
+	sort.Strings(params)
+	for _, p := range params {
+		i := strings.IndexByte(p, '=')
+		if i < 1 || i == len(p)-1 {
+			// Graphite does not allow tags without value
+			continue
+		}
+		b.WriteByte(';')
+		b.WriteString(sanitize(p[:i], false))
+		b.WriteByte('=')
+		b.WriteString(sanitize(p[i+1:], false))
+	}
+	return b.String()
+}
+
+// foldedPath builds path using template
+func (enc Encoder) foldedPath(e metrics.Event) string {
+	template := enc.Template
+	if len(template) == 0 {
+		template = DefaultTemplate
+	}
+
+	tags := map[string]string{}
+	for _, p := range e.Params {
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			tags[p[:i]] = p[i+1:]
+		} else {
+			tags[p] = p
+		}
+	}
+
+	segments := strings.Split(template, ".")
+	used := map[string]bool{}
+	for _, seg := range segments {
+		if len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}' {
+			used[seg[1:len(seg)-1]] = true
+		}
+	}
+
+	var path []string
+	for _, seg := range segments {
+		if len(seg) < 2 || seg[0] != '{' || seg[len(seg)-1] != '}' {
+			path = append(path, sanitize(seg, true))
+			continue
+		}
+		switch name := seg[1 : len(seg)-1]; name {
+		case "metric":
+			path = append(path, sanitize(e.Metric, false))
+		case "tags":
+			names := make([]string, 0, len(tags))
+			for name := range tags {
+				if !used[name] {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				path = append(path, sanitize(tags[name], true))
+			}
+		default:
+			path = append(path, sanitize(tags[name], true))
+		}
+	}
+
+	var b strings.Builder
+	for _, seg := range path {
+		if len(seg) == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(seg)
+	}
+	return b.String()
+}
+
+// sanitize replaces characters, not allowed in Graphite paths and tags,
+// with underscores. Dots are replaced too, when value is folded into
+// path as single segment.
+func sanitize(s string, dots bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r <= ' ' || r == 0x7f, r == ';', r == '=', r == '~', r == '!', r == '^':
+			return '_'
+		case r == '.' && dots:
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// AppendPlaintext appends events in plaintext protocol, like
+// "path value timestamp\n"
+func (enc Encoder) AppendPlaintext(dst []byte, ts time.Time, events []metrics.Event) []byte {
+	for _, e := range events {
+		dst = append(dst, enc.Path(e)...)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, e.Value, 10)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, ts.Unix(), 10)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// Pickle opcodes, used to encode list of (path, (timestamp, value)) tuples
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+)
+
+// AppendPickle appends events as single pickle protocol message,
+// prefixed with four bytes big endian length header, as carbon expects.
+func (enc Encoder) AppendPickle(dst []byte, ts time.Time, events []metrics.Event) []byte {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	dst = append(dst, pickleProto, 2, pickleEmptyList, pickleMark)
+	for _, e := range events {
+		path := enc.Path(e)
+		dst = append(dst, pickleBinUnicode)
+		dst = appendUint32LE(dst, uint32(len(path)))
+		dst = append(dst, path...)
+
+		dst = append(dst, pickleBinInt)
+		dst = appendUint32LE(dst, uint32(int32(ts.Unix())))
+		dst = append(dst, pickleBinFloat)
+		var f [8]byte
+		binary.BigEndian.PutUint64(f[:], math.Float64bits(float64(e.Value)))
+		dst = append(dst, f[:]...)
+		dst = append(dst, pickleTuple2, pickleTuple2)
+	}
+	dst = append(dst, pickleAppends, pickleStop)
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start-4))
+	return dst
+}
+
+func appendUint32LE(dst []byte, v uint32) []byte {
+	return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,156 @@
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+var testEvents = []metrics.Event{
+	{EventType: metrics.TypeIncrement, Metric: "api.hits", Value: 3, Params: []string{"host=a.local", "env=live"}},
+	{EventType: metrics.TypeGauge, Metric: "cpu load", Value: 7, Params: []string{"bare"}},
+}
+
+func TestEncoderPath(t *testing.T) {
+	assert := assert.New(t)
+
+	var enc Encoder
+	assert.Equal("api.hits;env=live;host=a.local", enc.Path(testEvents[0]))
+	assert.Equal("cpu_load", enc.Path(testEvents[1]))
+
+	enc = Encoder{Tags: TagsPath}
+	assert.Equal("api.hits.live.a_local", enc.Path(testEvents[0]))
+	assert.Equal("cpu_load.bare", enc.Path(testEvents[1]))
+
+	enc = Encoder{Tags: TagsPath, Template: "servers.{host}.{metric}.{tags}"}
+	assert.NoError(enc.Validate())
+	assert.Equal("servers.a_local.api.hits.live", enc.Path(testEvents[0]))
+	assert.Equal("servers.cpu_load.bare", enc.Path(testEvents[1]))
+
+	assert.Error(Encoder{Tags: TagsPath, Template: "{host}"}.Validate())
+	assert.Error(Encoder{Tags: "unknown"}.Validate())
+}
+
+func TestEncoderPlaintext(t *testing.T) {
+	out := Encoder{}.AppendPlaintext(nil, time.Unix(100, 0), testEvents)
+	assert.Equal(t, "api.hits;env=live;host=a.local 3 100\ncpu_load 7 100\n", string(out))
+}
+
+func TestEncoderPickle(t *testing.T) {
+	assert := assert.New(t)
+
+	out := Encoder{}.AppendPickle(nil, time.Unix(100, 0), testEvents[1:])
+	if assert.True(len(out) > 4) {
+		assert.Equal(uint32(len(out)-4), binary.BigEndian.Uint32(out))
+	}
+	// Loads as [("cpu_load", (100, 7.0))] in Python
+	assert.Equal(
+		"\x80\x02](X\x08\x00\x00\x00cpu_loadJd\x00\x00\x00G@\x1c\x00\x00\x00\x00\x00\x00\x86\x86e.",
+		string(out[4:]),
+	)
+}
+
+func TestSenderReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Every connection reads single line and is closed by server
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil {
+				lines <- line
+			}
+			conn.Close()
+		}
+	}()
+
+	s, err := NewSender(Config{Addr: ln.Addr().String(), Backoff: time.Millisecond})
+	if !assert.NoError(err) {
+		return
+	}
+	defer s.Close()
+
+	ts := time.Unix(100, 0)
+	assert.NoError(s.Write(ts, testEvents[1:]))
+	assert.Equal("cpu_load 7 100\n", <-lines)
+
+	// Writes into closed connection are lost or fail, sender must reconnect
+	deadline := time.After(5 * time.Second)
+	for {
+		assert.NoError(s.Write(ts, testEvents[1:]))
+		select {
+		case line := <-lines:
+			assert.Equal("cpu_load 7 100\n", line)
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Sender did not reconnect")
+		}
+	}
+}
+
+func TestSenderBufferLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	// Reserving port and releasing it, so connection is refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s, err := NewSender(Config{Addr: addr, BatchSize: 1, BufferSize: 50, Backoff: time.Hour})
+	if !assert.NoError(err) {
+		return
+	}
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(s.Write(time.Unix(100, 0), testEvents))
+	}
+	s.m.Lock()
+	assert.True(s.queued <= 50)
+	assert.True(len(s.queue) > 0)
+	assert.Equal("cpu_load 7 100\n", string(s.queue[len(s.queue)-1]))
+	s.m.Unlock()
+}
+
+func TestSenderCloseTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// Reserving port and releasing it, so connection is refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s, err := NewSender(Config{Addr: addr, Timeout: 50 * time.Millisecond, Backoff: time.Hour})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Write(time.Unix(100, 0), testEvents))
+
+	before := time.Now()
+	assert.Error(s.Close())
+	assert.True(time.Now().Sub(before) < time.Second)
+	s.m.Lock()
+	assert.Equal(0, s.queued)
+	s.m.Unlock()
+}
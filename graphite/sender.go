@@ -0,0 +1,244 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config contains Graphite sender settings
+type Config struct {
+	Addr       string        // Carbon address, like localhost:2003
+	Encoder    Encoder       // Paths and protocol settings
+	BatchSize  int           // Max metrics in single pickle message or plaintext write
+	BufferSize int           // Max bytes, waiting to be sent
+	Timeout    time.Duration // Dial, write and close timeout
+	Backoff    time.Duration // Delay before first reconnect, doubled on every next one
+	MaxBackoff time.Duration // Upper limit for delay between reconnects
+}
+
+// Sender sends metrics to carbon over TCP. Encoded metrics are placed
+// into bounded buffer and delivered by background goroutine, which
+// reconnects on failures. When buffer overflows, oldest data is dropped.
+type Sender struct {
+	cfg Config
+	log xray.Ray
+
+	m      sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	queued int
+	closed bool
+	done   chan struct{}
+}
+
+// NewSender builds new Graphite sender and starts delivery goroutine
+func NewSender(cfg Config) (*Sender, error) {
+	if len(cfg.Addr) == 0 {
+		return nil, errors.New("empty Graphite address")
+	}
+	if err := cfg.Encoder.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 8 << 20
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+
+	s := &Sender{
+		cfg:  cfg,
+		log:  xray.ROOT.Fork().WithLogger("graphite").WithMetricPrefix("graphite"),
+		done: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.m)
+	go s.loop()
+	return s, nil
+}
+
+// Write encodes events, flushed at given time, and places them into
+// send buffer. It does not block on network.
+func (s *Sender) Write(ts time.Time, events []metrics.Event) error {
+	for len(events) > 0 {
+		batch := events
+		if len(batch) > s.cfg.BatchSize {
+			batch = batch[:s.cfg.BatchSize]
+		}
+		events = events[len(batch):]
+
+		var chunk []byte
+		if s.cfg.Encoder.Pickle {
+			chunk = s.cfg.Encoder.AppendPickle(nil, ts, batch)
+		} else {
+			chunk = s.cfg.Encoder.AppendPlaintext(nil, ts, batch)
+		}
+		s.enqueue(chunk)
+	}
+	return nil
+}
+
+// enqueue adds chunk to buffer, dropping oldest chunks on overflow
+func (s *Sender) enqueue(chunk []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return
+	}
+
+	var dropped int
+	for len(s.queue) > 0 && s.queued+len(chunk) > s.cfg.BufferSize {
+		dropped += len(s.queue[0])
+		s.queued -= len(s.queue[0])
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+	}
+	if s.queued+len(chunk) > s.cfg.BufferSize {
+		// Chunk itself does not fit into buffer
+		dropped += len(chunk)
+	} else {
+		s.queue = append(s.queue, chunk)
+		s.queued += len(chunk)
+	}
+	if dropped > 0 {
+		s.log.Increment("dropped", int64(dropped))
+		s.log.Warning("Send buffer overflow, dropped :count bytes", args.Count(dropped))
+	}
+	s.cond.Signal()
+}
+
+// Close stops accepting data and waits until remaining data is sent,
+// but no longer than timeout. Data, not sent in time, is dropped.
+func (s *Sender) Close() error {
+	s.m.Lock()
+	s.closed = true
+	s.cond.Signal()
+	s.m.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(s.cfg.Timeout):
+	}
+
+	s.m.Lock()
+	dropped := s.queued
+	s.queue = nil
+	s.queued = 0
+	s.m.Unlock()
+	if dropped == 0 {
+		return nil
+	}
+	s.log.Increment("dropped", int64(dropped))
+	return fmt.Errorf("graphite sender closed with %d bytes not sent", dropped)
+}
+
+// next returns chunk at head of buffer, waiting for it if needed.
+// Returns nil when sender is closed and buffer is empty.
+func (s *Sender) next() []byte {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.queue) == 0 {
+		return nil
+	}
+	return s.queue[0]
+}
+
+// sent removes delivered chunk from head of buffer, unless it was
+// already dropped due to overflow
+func (s *Sender) sent(chunk []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.queue) > 0 && &s.queue[0][0] == &chunk[0] {
+		s.queued -= len(chunk)
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+	}
+}
+
+func (s *Sender) isClosed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.closed
+}
+
+// loop delivers buffered chunks, reconnecting with backoff
+func (s *Sender) loop() {
+	defer close(s.done)
+
+	var conn net.Conn
+	var failures int
+	for {
+		chunk := s.next()
+		if chunk == nil {
+			break
+		}
+
+		if conn == nil {
+			var err error
+			conn, err = net.DialTimeout("tcp", s.cfg.Addr, s.cfg.Timeout)
+			if err != nil {
+				s.log.Inc("error", args.Type("dial"))
+				s.log.Error("Unable to connect to :addr - :err", args.Addr(s.cfg.Addr), args.Error{Err: err})
+				if s.isClosed() {
+					break
+				}
+				failures++
+				time.Sleep(s.backoff(failures))
+				continue
+			}
+			s.log.Inc("connect")
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(s.cfg.Timeout))
+		if _, err := conn.Write(chunk); err != nil {
+			// Chunk stays in buffer and will be sent again after reconnect,
+			// so carbon may receive part of it twice
+			s.log.Inc("error", args.Type("io"))
+			s.log.Error("Error sending data to :addr - :err", args.Addr(s.cfg.Addr), args.Error{Err: err})
+			_ = conn.Close()
+			conn = nil
+			if s.isClosed() {
+				break
+			}
+			failures++
+			time.Sleep(s.backoff(failures))
+			continue
+		}
+		failures = 0
+		s.sent(chunk)
+		s.log.Increment("sent", int64(len(chunk)))
+	}
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// backoff returns delay before reconnect after given amount of failures
+func (s *Sender) backoff(failures int) time.Duration {
+	d := s.cfg.Backoff
+	for i := 1; i < failures && d < s.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.cfg.MaxBackoff {
+		d = s.cfg.MaxBackoff
+	}
+	return d
+}
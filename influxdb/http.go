@@ -0,0 +1,155 @@
+package influxdb
+
+import (
+	"errors"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/dogrelay/transport"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPConfig contains settings of InfluxDB HTTP write API
+type HTTPConfig struct {
+	URL     string // Base URL, like http://localhost:8086
+	Version int    // API version, 1 for /write and 2 for /api/v2/write
+
+	// API v1 settings
+	Database        string
+	RetentionPolicy string
+	Username        string
+	Password        string
+
+	// API v2 settings
+	Org    string
+	Bucket string
+	Token  string
+
+	Precision  string        // Timestamps precision - ns, us, ms or s, empty for none
+	Fields     bool          // Group aggregated statistics into fields
+	BatchSize  int           // Max lines in single request
+	Timeout    time.Duration // Single request timeout
+	MaxRetries int           // Retries of failed request
+	Backoff    time.Duration // Delay before first retry
+	Gzip       bool          // Compress batches
+}
+
+// HTTPWriter sends metrics events to InfluxDB HTTP write API
+type HTTPWriter struct {
+	url       string
+	header    http.Header
+	encoder   Encoder
+	batchSize int
+	http      *transport.HTTP
+	log       xray.Ray
+}
+
+// NewHTTPWriter builds and returns new InfluxDB HTTP writer
+func NewHTTPWriter(cfg HTTPConfig) (*HTTPWriter, error) {
+	if len(cfg.URL) == 0 {
+		return nil, errors.New("empty InfluxDB URL")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 5000
+	}
+
+	w := &HTTPWriter{
+		header:    http.Header{},
+		encoder:   Encoder{Precision: cfg.Precision, Fields: cfg.Fields},
+		batchSize: cfg.BatchSize,
+		http:      transport.NewHTTP(cfg.Timeout, cfg.MaxRetries, cfg.Backoff, cfg.Gzip),
+		log:       xray.ROOT.Fork().WithLogger("influxdb-http").WithMetricPrefix("influxdb"),
+	}
+	if err := w.encoder.Validate(); err != nil {
+		return nil, err
+	}
+	w.header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	query := url.Values{}
+	base := strings.TrimRight(cfg.URL, "/")
+	switch cfg.Version {
+	case 0, 1:
+		if len(cfg.Database) == 0 {
+			return nil, errors.New("InfluxDB database not provided")
+		}
+		query.Set("db", cfg.Database)
+		switch cfg.Precision {
+		case "":
+		case "ns":
+			query.Set("precision", "n")
+		case "us":
+			query.Set("precision", "u")
+		default:
+			query.Set("precision", cfg.Precision)
+		}
+		if len(cfg.RetentionPolicy) > 0 {
+			query.Set("rp", cfg.RetentionPolicy)
+		}
+		if len(cfg.Username) > 0 {
+			req := http.Request{Header: http.Header{}}
+			req.SetBasicAuth(cfg.Username, cfg.Password)
+			w.header.Set("Authorization", req.Header.Get("Authorization"))
+		}
+		w.url = base + "/write?" + query.Encode()
+	case 2:
+		if len(cfg.Org) == 0 || len(cfg.Bucket) == 0 {
+			return nil, errors.New("InfluxDB organization and bucket are required for API v2")
+		}
+		query.Set("org", cfg.Org)
+		query.Set("bucket", cfg.Bucket)
+		if len(cfg.Precision) > 0 {
+			query.Set("precision", cfg.Precision)
+		}
+		if len(cfg.Token) > 0 {
+			w.header.Set("Authorization", "Token "+cfg.Token)
+		}
+		w.url = base + "/api/v2/write?" + query.Encode()
+	default:
+		return nil, errors.New("unsupported InfluxDB API version")
+	}
+
+	return w, nil
+}
+
+// Write sends events, flushed at given time, to InfluxDB in batches.
+// Failed batches are retried, first error is returned after all batches
+// are processed.
+func (w *HTTPWriter) Write(ts time.Time, events []metrics.Event) error {
+	var first error
+	var body []byte
+	lines := 0
+
+	send := func() {
+		before := time.Now()
+		err := w.http.Post(w.url, w.header, body)
+		w.log.Duration("http.latency", time.Now().Sub(before))
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			w.log.Error("Unable to write :count lines to InfluxDB - :err", args.Count(lines), args.Error{Err: err})
+			w.log.Inc("http.error", args.Type(transport.ErrorType(err)))
+		} else {
+			w.log.Inc("http.success")
+			w.log.Increment("http.lines", int64(lines))
+		}
+		body = body[:0]
+		lines = 0
+	}
+
+	w.encoder.Each(ts, events, func(line []byte) {
+		body = append(body, line...)
+		lines++
+		if lines >= w.batchSize {
+			send()
+		}
+	})
+	if lines > 0 {
+		send()
+	}
+
+	return first
+}
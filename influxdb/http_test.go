@@ -0,0 +1,102 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPWriterV1(t *testing.T) {
+	assert := assert.New(t)
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/write", r.URL.Path)
+		assert.Equal("metrics", r.URL.Query().Get("db"))
+		assert.Equal("week", r.URL.Query().Get("rp"))
+		user, pass, ok := r.BasicAuth()
+		assert.True(ok)
+		assert.Equal("admin", user)
+		assert.Equal("secret", pass)
+		assert.Equal("gzip", r.Header.Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(r.Body)
+		if assert.NoError(err) {
+			body, _ := ioutil.ReadAll(gz)
+			bodies = append(bodies, string(body))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w, err := NewHTTPWriter(HTTPConfig{
+		URL:             server.URL,
+		Database:        "metrics",
+		RetentionPolicy: "week",
+		Username:        "admin",
+		Password:        "secret",
+		BatchSize:       2,
+		Gzip:            true,
+	})
+	if assert.NoError(err) {
+		assert.NoError(w.Write(time.Time{}, []metrics.Event{
+			{Metric: "a", Value: 1},
+			{Metric: "b", Value: 2, Params: []string{"host=x"}},
+			{Metric: "c", Value: 3},
+		}))
+		assert.Equal([]string{"a value=1\nb,host=x value=2\n", "c value=3\n"}, bodies)
+	}
+}
+
+func TestHTTPWriterV2Retries(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/api/v2/write", r.URL.Path)
+		assert.Equal("org", r.URL.Query().Get("org"))
+		assert.Equal("bucket", r.URL.Query().Get("bucket"))
+		assert.Equal("Token abc", r.Header.Get("Authorization"))
+		switch atomic.AddInt32(&calls, 1) {
+		case 1, 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	w, err := NewHTTPWriter(HTTPConfig{URL: server.URL, Version: 2, Org: "org", Bucket: "bucket", Token: "abc", MaxRetries: 3})
+	if assert.NoError(err) {
+		assert.NoError(w.Write(time.Time{}, []metrics.Event{{Metric: "a", Value: 1}}))
+		assert.Equal(int32(3), atomic.LoadInt32(&calls))
+	}
+}
+
+func TestHTTPWriterClientError(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"unable to parse"}`))
+	}))
+	defer server.Close()
+
+	w, err := NewHTTPWriter(HTTPConfig{URL: server.URL, Database: "metrics", MaxRetries: 3})
+	if assert.NoError(err) {
+		err := w.Write(time.Time{}, []metrics.Event{{Metric: "a", Value: 1}})
+		if assert.Error(err) {
+			assert.Contains(err.Error(), "unable to parse")
+		}
+		// Client errors are not retried
+		assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	}
+}
@@ -0,0 +1,134 @@
+package influxdb
+
+import (
+	"fmt"
+	"github.com/mono83/dogrelay/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// precisions contains supported timestamp precisions with their units
+var precisions = map[string]int64{
+	"ns": int64(time.Nanosecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+}
+
+// Encoder converts metrics events into InfluxDB line protocol
+type Encoder struct {
+	// Precision of timestamps - ns, us, ms or s. Empty precision means
+	// no timestamps, so InfluxDB uses arrival time.
+	Precision string
+
+	// Fields enables grouping of aggregated statistics, like timer count
+	// and percentiles, into single point with many fields instead of
+	// many suffixed measurements.
+	Fields bool
+}
+
+// Validate checks encoder configuration
+func (enc Encoder) Validate() error {
+	if _, ok := precisions[enc.Precision]; !ok && len(enc.Precision) > 0 {
+		return fmt.Errorf("unsupported timestamp precision %q", enc.Precision)
+	}
+	return nil
+}
+
+// Each encodes given events, flushed at given time, and invokes callback
+// for each line. Line slice is reused and valid only during callback.
+// In fields mode statistics of same group must follow each other, as
+// Buffer.Flush produces them.
+func (enc Encoder) Each(ts time.Time, events []metrics.Event, fn func([]byte)) {
+	var line []byte
+	for i := 0; i < len(events); {
+		e := events[i]
+		if enc.Fields && len(e.Group) > 0 {
+			line = appendSeries(line[:0], e.Group, e.Params)
+			j := i
+			for ; j < len(events) && events[j].Group == e.Group && equalParams(events[j].Params, e.Params); j++ {
+				if j == i {
+					line = append(line, ' ')
+				} else {
+					line = append(line, ',')
+				}
+				line = appendEscaped(line, events[j].Field, tagSpecials)
+				line = append(line, '=')
+				line = strconv.AppendInt(line, events[j].Value, 10)
+			}
+			i = j
+		} else {
+			line = appendSeries(line[:0], e.Metric, e.Params)
+			line = append(line, " value="...)
+			line = strconv.AppendInt(line, e.Value, 10)
+			i++
+		}
+
+		if unit, ok := precisions[enc.Precision]; ok {
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, ts.UnixNano()/unit, 10)
+		}
+		fn(append(line, '\n'))
+	}
+}
+
+// Special characters, that must be escaped
+const (
+	measurementSpecials = ", "
+	tagSpecials         = ",= "
+)
+
+// appendSeries appends escaped measurement name and tags. Params without
+// value are skipped, because line protocol does not allow empty tag values.
+func appendSeries(dst []byte, measurement string, params []string) []byte {
+	if len(measurement) > 0 && measurement[0] == '#' {
+		// Lines, starting with hash, are comments
+		dst = append(dst, '_')
+		measurement = measurement[1:]
+	}
+	dst = appendEscaped(dst, measurement, measurementSpecials)
+	for _, param := range params {
+		i := strings.IndexByte(param, '=')
+		if i < 1 || i == len(param)-1 {
+			continue
+		}
+		dst = append(dst, ',')
+		dst = appendEscaped(dst, param[:i], tagSpecials)
+		dst = append(dst, '=')
+		dst = appendEscaped(dst, param[i+1:], tagSpecials)
+	}
+	return dst
+}
+
+// appendEscaped appends string, escaping given special characters with
+// backslash. Line breaks can not be escaped and are replaced with underscore.
+// So are backslashes before special characters and at the end of string,
+// because they would escape next character themselves.
+func appendEscaped(dst []byte, s string, specials string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\n' || c == '\r':
+			c = '_'
+		case c == '\\' && (i == len(s)-1 || strings.IndexByte(specials, s[i+1]) >= 0):
+			c = '_'
+		case strings.IndexByte(specials, c) >= 0:
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+func equalParams(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
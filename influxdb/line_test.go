@@ -0,0 +1,232 @@
+package influxdb
+
+import (
+	"errors"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeAll(enc Encoder, ts time.Time, events []metrics.Event) (lines []string) {
+	enc.Each(ts, events, func(line []byte) {
+		lines = append(lines, string(line))
+	})
+	return
+}
+
+func TestEncoderTimestamps(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := time.Unix(1600000000, 0)
+	events := []metrics.Event{{Metric: "cpu", Value: 5, Params: []string{"host=a"}}}
+
+	assert.Equal([]string{"cpu,host=a value=5\n"}, encodeAll(Encoder{}, ts, events))
+	assert.Equal([]string{"cpu,host=a value=5 1600000000\n"}, encodeAll(Encoder{Precision: "s"}, ts, events))
+	assert.Equal([]string{"cpu,host=a value=5 1600000000000\n"}, encodeAll(Encoder{Precision: "ms"}, ts, events))
+	assert.NoError(Encoder{Precision: "us"}.Validate())
+	assert.Error(Encoder{Precision: "m"}.Validate())
+}
+
+func TestEncoderFields(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := metrics.NewShardedBuffer(1, []int{95}, false)
+	buf.Add(metrics.Event{EventType: metrics.TypeDuration, Metric: "latency", Value: 10, Params: []string{"host=a"}})
+	buf.Add(metrics.Event{EventType: metrics.TypeDuration, Metric: "latency", Value: 20, Params: []string{"host=a"}})
+	buf.Add(metrics.Event{EventType: metrics.TypeIncrement, Metric: "hits", Value: 3})
+	events, _, _ := buf.Flush(10)
+
+	lines := encodeAll(Encoder{Precision: "s", Fields: true}, time.Unix(10, 0), events)
+	assert.Equal([]string{
+		"hits value=3 10\n",
+		"latency,host=a count=2,sum=30,avg=15,min=10,max=20,lower=10,upper=20,mean_95=15,upper_95=20,perc_95=20 10\n",
+	}, lines)
+
+	// Without fields mode each statistic is own measurement
+	assert.Len(encodeAll(Encoder{}, time.Unix(10, 0), events), 11)
+}
+
+// scanToken reads line protocol token until one of unescaped delimiters.
+// Backslash escapes only given escapable characters, like InfluxDB does.
+func scanToken(s, delims, escapable string) (token, rest string, delim byte) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			if strings.IndexByte(escapable, s[i+1]) < 0 {
+				b.WriteByte(c)
+			}
+			b.WriteByte(s[i+1])
+			i++
+			continue
+		}
+		if strings.IndexByte(delims, c) >= 0 {
+			return b.String(), s[i+1:], c
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), "", 0
+}
+
+// parseLine is minimal line protocol parser, used to verify encoder
+func parseLine(line string) (measurement string, tags, fields map[string]string, err error) {
+	if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+		return "", nil, nil, errors.New("line must contain single trailing line break")
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	tags = map[string]string{}
+	fields = map[string]string{}
+	var key, value string
+	var delim byte
+	measurement, line, delim = scanToken(line, ", ", ", ")
+	for delim == ',' {
+		key, line, delim = scanToken(line, "=", ",= ")
+		if delim != '=' || len(key) == 0 {
+			return "", nil, nil, errors.New("invalid tag key")
+		}
+		value, line, delim = scanToken(line, ", ", ",= ")
+		if len(value) == 0 {
+			return "", nil, nil, errors.New("empty tag value")
+		}
+		tags[key] = value
+	}
+	if delim != ' ' {
+		return "", nil, nil, errors.New("fields expected")
+	}
+	for delim != 0 {
+		key, line, delim = scanToken(line, "=", ",= ")
+		if delim != '=' || len(key) == 0 {
+			return "", nil, nil, errors.New("invalid field key")
+		}
+		value, line, delim = scanToken(line, ", ", "")
+		fields[key] = value
+		if delim == ' ' {
+			break
+		}
+	}
+	return
+}
+
+func TestEncoderEscaping(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := encodeAll(Encoder{}, time.Time{}, []metrics.Event{
+		{Metric: "http requests,total", Value: 1, Params: []string{"path=/a b", "query=x=1,y=2", "empty=", "flag"}},
+		{Metric: "#comment\nline", Value: 2, Params: []string{"trailing=a\\"}},
+	})
+	assert.Equal([]string{
+		"http\\ requests\\,total,path=/a\\ b,query=x\\=1\\,y\\=2 value=1\n",
+		"_comment_line,trailing=a_ value=2\n",
+	}, lines)
+
+	measurement, tags, fields, err := parseLine(lines[0])
+	if assert.NoError(err) {
+		assert.Equal("http requests,total", measurement)
+		assert.Equal(map[string]string{"path": "/a b", "query": "x=1,y=2"}, tags)
+		assert.Equal(map[string]string{"value": "1"}, fields)
+	}
+}
+
+// TestEncoderSpecGolden checks encoder against examples of InfluxDB line
+// protocol reference: measurement escapes commas and spaces, tag keys and
+// values escape commas, equals signs and spaces, other characters, quotes
+// and lone backslashes included, are literal. Parsed expectations also keep
+// parseLine, used by fuzzing, in line with reference.
+func TestEncoderSpecGolden(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		metric      string
+		params      []string
+		line        string
+		measurement string
+		tags        map[string]string
+	}{
+		{
+			"my Measurement", nil,
+			"my\\ Measurement value=1\n",
+			"my Measurement", map[string]string{},
+		},
+		{
+			"myMeasurement", []string{"tag Key1=tag Value1", "tag Key2=tag Value2"},
+			"myMeasurement,tag\\ Key1=tag\\ Value1,tag\\ Key2=tag\\ Value2 value=1\n",
+			"myMeasurement", map[string]string{"tag Key1": "tag Value1", "tag Key2": "tag Value2"},
+		},
+		{
+			"cpu,01", []string{"host=server,01"},
+			"cpu\\,01,host=server\\,01 value=1\n",
+			"cpu,01", map[string]string{"host": "server,01"},
+		},
+		{
+			"cpu=load", []string{"a=b=c"},
+			"cpu=load,a=b\\=c value=1\n",
+			"cpu=load", map[string]string{"a": "b=c"},
+		},
+		{
+			"\"measurement with quotes\"", []string{"tag=\"quoted\""},
+			"\"measurement\\ with\\ quotes\",tag=\"quoted\" value=1\n",
+			"\"measurement with quotes\"", map[string]string{"tag": "\"quoted\""},
+		},
+		{
+			"my\\Measurement", []string{"path=C:\\dir"},
+			"my\\Measurement,path=C:\\dir value=1\n",
+			"my\\Measurement", map[string]string{"path": "C:\\dir"},
+		},
+		{
+			"myMeasurement", []string{"tagKey=🍭"},
+			"myMeasurement,tagKey=🍭 value=1\n",
+			"myMeasurement", map[string]string{"tagKey": "🍭"},
+		},
+	} {
+		lines := encodeAll(Encoder{}, time.Time{}, []metrics.Event{{Metric: c.metric, Value: 1, Params: c.params}})
+		if !assert.Equal([]string{c.line}, lines) {
+			continue
+		}
+		measurement, tags, fields, err := parseLine(c.line)
+		if assert.NoError(err, c.line) {
+			assert.Equal(c.measurement, measurement)
+			assert.Equal(c.tags, tags)
+			assert.Equal(map[string]string{"value": "1"}, fields)
+		}
+	}
+}
+
+func FuzzEncoderRoundTrip(f *testing.F) {
+	f.Add("cpu", "host", "a")
+	f.Add("http requests", "path", "/a b,c=d")
+	f.Add("a,b", "x y", "1\\2")
+	f.Add("a\\", "b\\", "c\\")
+	f.Add("a\nb", "c\r", "=")
+
+	f.Fuzz(func(t *testing.T, name, key, value string) {
+		if len(name) == 0 || name[0] == '#' || len(key) == 0 || len(value) == 0 || strings.ContainsRune(key, '=') {
+			return
+		}
+
+		lines := encodeAll(Encoder{Precision: "s"}, time.Unix(1, 0), []metrics.Event{
+			{Metric: name, Value: 5, Params: []string{key + "=" + value}},
+		})
+		if len(lines) != 1 {
+			t.Fatalf("expected single line, got %q", lines)
+		}
+		measurement, tags, fields, err := parseLine(lines[0])
+		if err != nil {
+			t.Fatalf("unable to parse %q - %s", lines[0], err)
+		}
+		if fields["value"] != "5" || len(tags) != 1 {
+			t.Fatalf("unexpected tags %v or fields %v in %q", tags, fields, lines[0])
+		}
+
+		// Backslashes and line breaks may be sanitised, everything else
+		// must survive round trip exactly
+		if strings.ContainsAny(name+key+value, "\\\n\r") {
+			return
+		}
+		if measurement != name || tags[key] != value {
+			t.Fatalf("round trip of %q %q=%q produced %q %v", name, key, value, measurement, tags)
+		}
+	})
+}
@@ -1,117 +1,314 @@
 package metrics
 
 import (
+	"runtime"
 	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // Buffer structure contains buffered information about
 // metrics events and can be used to provide aggregated one
 type Buffer struct {
-	lock sync.Mutex
-
 	percentiles []int
 	compatMode  bool
 
+	gaugeMode  GaugeMode
+	gaugeRules []GaugeRule
+
+	sendZeros int
+	evictIdle int
+
+	stateMaxAge time.Duration
+
+	shards []*shard
+}
+
+// shard is independently locked partition of Buffer
+type shard struct {
+	lock sync.Mutex
+
 	received int
 
-	prototypes map[string]Event
-	counters   map[string]int64
-	gauges     map[string]int64
-	durations  map[string][]int64
+	series map[string]*series
+}
+
+// series holds aggregation state of single metric key. Series stay in
+// shard until evicted as idle, so their keys act as interned strings and
+// repeated events for known series are registered without allocations.
+type series struct {
+	proto  Event
+	active bool
+
+	value  int64   // Counter sum
+	values []int64 // Durations
+
+	gauge     gaugeState
+	gaugeMode GaugeMode
+
+	idle int // Count of windows without events
 }
 
-// NewBuffer builds new Buffer
+// NewBuffer builds new Buffer with one shard per available CPU
 func NewBuffer(percentiles []int, compatMode bool) *Buffer {
-	return &Buffer{
+	return NewShardedBuffer(runtime.NumCPU(), percentiles, compatMode)
+}
+
+// NewShardedBuffer builds new Buffer, partitioned by metric key hash into
+// given amount of shards. Each shard has own lock, so concurrent Add calls
+// for different metrics do not contend with each other.
+func NewShardedBuffer(shards int, percentiles []int, compatMode bool) *Buffer {
+	if shards < 1 {
+		shards = 1
+	}
+
+	b := &Buffer{
 		percentiles: percentiles,
 		compatMode:  compatMode,
-		prototypes:  map[string]Event{},
-		counters:    map[string]int64{},
-		gauges:      map[string]int64{},
-		durations:   map[string][]int64{},
+		shards:      make([]*shard, shards),
+	}
+	for i := range b.shards {
+		b.shards[i] = &shard{series: map[string]*series{}}
 	}
+	return b
 }
 
+// Shards returns amount of partitions, used by buffer
+func (b *Buffer) Shards() int {
+	return len(b.shards)
+}
+
+// SetGaugeModes configures gauge aggregation. Mode of first rule, which
+// pattern matches metric name, is used, otherwise default one.
+// Must be called before any event is added.
+func (b *Buffer) SetGaugeModes(def GaugeMode, rules []GaugeRule) {
+	b.gaugeMode = def
+	b.gaugeRules = rules
+}
+
+// SetSendZeros configures amount of idle windows, during which zero values
+// are reported for counters and timer counts without events. After that
+// series are forgotten. Zero disables reporting and forgetting of idle series.
+// Must be called before any event is added.
+func (b *Buffer) SetSendZeros(windows int) {
+	if windows < 0 {
+		windows = 0
+	}
+	b.sendZeros = windows
+}
+
+// SetEvictIdle configures amount of idle windows, after which series of
+// any type are forgotten, regardless of send zeros setting, so high key
+// cardinality does not grow buffer without bound. Zero disables eviction.
+// Must be called before any event is added.
+func (b *Buffer) SetEvictIdle(windows int) {
+	if windows < 0 {
+		windows = 0
+	}
+	b.evictIdle = windows
+}
+
+// gaugeModeFor returns gauge aggregation mode for given metric name
+func (b *Buffer) gaugeModeFor(metric string) GaugeMode {
+	for _, r := range b.gaugeRules {
+		if r.Matches(metric) {
+			return r.Mode
+		}
+	}
+	return b.gaugeMode
+}
+
+// newSeries builds series for given prototype
+func (b *Buffer) newSeries(proto Event) *series {
+	se := &series{proto: proto}
+	if proto.EventType == TypeGauge {
+		se.gaugeMode = b.gaugeModeFor(proto.Metric)
+	}
+	return se
+}
+
+// shardFor returns shard, responsible for given key
+func (b *Buffer) shardFor(key []byte) *shard {
+	if len(b.shards) == 1 {
+		return b.shards[0]
+	}
+	return b.shards[fnv32a(key)%uint32(len(b.shards))]
+}
+
+// fnv32a calculates FNV-1a hash of given bytes
+func fnv32a(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+// keyScratchSize is size of stack allocated buffer for keys in Add
+const keyScratchSize = 256
+
 // Add registers new event
 func (b *Buffer) Add(e Event) {
-	// Reading key
-	key := e.Key()
+	var scratch [keyScratchSize]byte
+	b.add(e.AppendKey(scratch[:0]), e.Value, e)
+}
 
-	b.lock.Lock()
-	defer b.lock.Unlock()
+// AddKey registers new event, given as key in format, produced by
+// Event.AppendKey, and value. Does not allocate memory for already known keys.
+func (b *Buffer) AddKey(key []byte, value int64) {
+	b.add(key, value, Event{})
+}
 
-	if _, ok := b.prototypes[key]; !ok {
-		// Storing prototype event
-		b.prototypes[key] = e
+func (b *Buffer) add(key []byte, value int64, proto Event) {
+	if len(key) < 2 {
+		return
+	}
+	switch key[0] {
+	case TypeIncrement, TypeGauge, TypeDuration:
+	default:
+		// Unknown type, rejected before series is registered
+		return
 	}
 
-	switch e.EventType {
-	case TypeIncrement:
-		prev, ok := b.counters[key]
-		if ok {
-			b.counters[key] = prev + e.Value
-		} else {
-			b.counters[key] = e.Value
+	s := b.shardFor(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	se, ok := s.series[string(key)]
+	if !ok {
+		// Registering new series with prototype event
+		k := string(key)
+		if proto.EventType == 0 {
+			proto = EventFromKey(k)
 		}
-		b.received++
+		se = b.newSeries(proto)
+		s.series[k] = se
+	}
+
+	switch key[0] {
+	case TypeIncrement:
+		se.value += value
 	case TypeGauge:
-		b.gauges[key] = e.Value
-		b.received++
+		se.gauge.add(value, !se.active)
 	case TypeDuration:
-		b.durations[key] = append(b.durations[key], e.Value)
-		b.received++
+		se.values = append(se.values, value)
 	}
+	se.active = true
+	s.received++
 }
 
 // Flush flushes buffered events into aggregated list
 func (b *Buffer) Flush(elapsed int) ([]Event, int, int) {
 	result := []Event{}
+	recCount := 0
 
-	// First lock - working with counters and gauges, and copying
-	// durations to local variable
-	b.lock.Lock()
+	// Durations are copied to local variables together with their
+	// prototypes, so sorting and flattening happen outside of locks
+	var durations [][]int64
+	var prototypes []Event
 
-	recCount := b.received
-	b.received = 0
-	for k, v := range b.gauges {
-		if b.compatMode {
-			result = append(result, b.prototypes[k].WithValueSuffix(v, ".gauge"))
-		} else {
-			result = append(result, b.prototypes[k].WithValue(v))
+	for _, s := range b.shards {
+		s.lock.Lock()
+
+		recCount += s.received
+		s.received = 0
+		for k, se := range s.series {
+			if se.active {
+				se.idle = 0
+			} else {
+				se.idle++
+			}
+			zero := !se.active && b.sendZeros > 0 && se.idle <= b.sendZeros
+
+			switch se.proto.EventType {
+			case TypeGauge:
+				// Gauges are reported even without new values
+				result = b.appendGauge(result, se)
+			case TypeIncrement:
+				if se.active || zero {
+					if b.compatMode {
+						result = append(result, se.proto.WithValueSuffix(se.value, ".counter"))
+					} else {
+						result = append(result, se.proto.WithValue(se.value))
+					}
+				}
+				se.value = 0
+			case TypeDuration:
+				if se.active {
+					durations = append(durations, append([]int64(nil), se.values...))
+					prototypes = append(prototypes, se.proto)
+				} else if zero {
+					result = b.appendIdleTimer(result, se.proto, elapsed)
+				}
+				// Keeping allocated memory for next window
+				se.values = se.values[:0]
+			}
+			se.active = false
+
+			if b.sendZeros > 0 && se.idle > b.sendZeros && se.proto.EventType != TypeGauge {
+				// Forgetting idle series
+				delete(s.series, k)
+			} else if b.evictIdle > 0 && se.idle > b.evictIdle && se.idle > b.sendZeros {
+				// Evicting long idle series, including gauges
+				delete(s.series, k)
+			}
 		}
+
+		s.lock.Unlock()
+	}
+
+	// Flattening
+	for i, v := range durations {
+		result = append(result, b.flatten(prototypes[i], int64arr(v), elapsed)...)
 	}
-	for k, v := range b.counters {
+
+	return result, recCount, len(result)
+}
+
+// appendGauge appends aggregated gauge values to result
+func (b *Buffer) appendGauge(result []Event, se *series) []Event {
+	compatPrefix := ""
+	if b.compatMode {
+		compatPrefix = ".gauge"
+	}
+
+	if se.gaugeMode != GaugeAll {
 		if b.compatMode {
-			result = append(result, b.prototypes[k].WithValueSuffix(v, ".counter"))
-		} else {
-			result = append(result, b.prototypes[k].WithValue(v))
+			return append(result, se.proto.WithValueSuffix(gaugeValue(se, se.gaugeMode), compatPrefix))
 		}
+		return append(result, se.proto.WithValue(gaugeValue(se, se.gaugeMode)))
 	}
 
-	b.counters = map[string]int64{}
-	local := b.durations
-	b.durations = map[string][]int64{}
-	b.lock.Unlock()
-
-	if len(local) == 0 {
-		return result, 0, 0
+	for _, mode := range []GaugeMode{GaugeLast, GaugeMin, GaugeMax, GaugeAvg, GaugeSum} {
+		result = append(result, se.proto.WithField(gaugeValue(se, mode), compatPrefix, mode.String()))
 	}
+	return result
+}
 
-	// Reading all prototypes, used by durations
-	prototypes := make(map[string]Event, len(local))
-	b.lock.Lock()
-	for k := range local {
-		prototypes[k] = b.prototypes[k]
+// gaugeValue returns aggregated gauge value for given mode. Idle gauge
+// repeats its last, min, max and avg values, but sum of idle window is
+// zero, otherwise downstream totals would grow without new values.
+func gaugeValue(se *series, mode GaugeMode) int64 {
+	if mode == GaugeSum && !se.active {
+		return 0
 	}
-	b.lock.Unlock()
+	return se.gauge.value(mode)
+}
 
-	// Flattening
-	for k, v := range local {
-		result = append(result, b.flatten(prototypes[k], int64arr(v), elapsed)...)
+// appendIdleTimer appends zero count values of timer without events
+func (b *Buffer) appendIdleTimer(result []Event, proto Event, elapsed int) []Event {
+	compatPrefix := ""
+	if b.compatMode {
+		compatPrefix = ".timer"
 	}
 
-	return result, recCount, len(result)
+	result = append(result, proto.WithField(0, compatPrefix, "count"))
+	if b.compatMode && elapsed > 0 {
+		result = append(result, proto.WithField(0, compatPrefix, "count_ps"))
+	}
+	return result
 }
 
 func (b *Buffer) flatten(proto Event, values int64arr, elapsed int) []Event {
@@ -131,23 +328,24 @@ func (b *Buffer) flatten(proto Event, values int64arr, elapsed int) []Event {
 	}
 	avg = sum / int64(count)
 
-	result = append(result, proto.WithValueSuffix(int64(count), compatPrefix+".count"))
-	result = append(result, proto.WithValueSuffix(sum, compatPrefix+".sum"))
-	result = append(result, proto.WithValueSuffix(avg, compatPrefix+".avg"))
-	result = append(result, proto.WithValueSuffix(values[0], compatPrefix+".min"))
-	result = append(result, proto.WithValueSuffix(values[len(values)-1], compatPrefix+".max"))
+	result = append(result, proto.WithField(int64(count), compatPrefix, "count"))
+	result = append(result, proto.WithField(sum, compatPrefix, "sum"))
+	result = append(result, proto.WithField(avg, compatPrefix, "avg"))
+	result = append(result, proto.WithField(values[0], compatPrefix, "min"))
+	result = append(result, proto.WithField(values[len(values)-1], compatPrefix, "max"))
 
 	// StatsD compatibility layer
-	result = append(result, proto.WithValueSuffix(values[0], compatPrefix+".lower"))
-	result = append(result, proto.WithValueSuffix(values[len(values)-1], compatPrefix+".upper"))
+	result = append(result, proto.WithField(values[0], compatPrefix, "lower"))
+	result = append(result, proto.WithField(values[len(values)-1], compatPrefix, "upper"))
 
 	if b.compatMode && elapsed > 0 {
-		result = append(result, proto.WithValueSuffix(int64(count/elapsed), compatPrefix+".count_ps"))
+		result = append(result, proto.WithField(int64(count/elapsed), compatPrefix, "count_ps"))
 	}
 
 	// Calculating percentiles
 	var percSum, upperSum int64
 	for _, perc := range b.percentiles {
+		suffix := strconv.Itoa(perc)
 		percIndex := int(perc * count / 100)
 		meanList := values[0 : percIndex+1]
 		upperList := values[percIndex:]
@@ -157,17 +355,17 @@ func (b *Buffer) flatten(proto Event, values int64arr, elapsed int) []Event {
 			for _, v := range meanList {
 				percSum += v
 			}
-			result = append(result, proto.WithValueSuffixI(percSum/int64(len(meanList)), compatPrefix+".mean_", perc))
+			result = append(result, proto.WithField(percSum/int64(len(meanList)), compatPrefix, "mean_"+suffix))
 		}
 		if len(upperList) > 0 {
 			for _, v := range upperList {
 				upperSum += v
 			}
-			result = append(result, proto.WithValueSuffixI(upperSum/int64(len(upperList)), compatPrefix+".upper_", perc))
+			result = append(result, proto.WithField(upperSum/int64(len(upperList)), compatPrefix, "upper_"+suffix))
 		} else {
-			result = append(result, proto.WithValueSuffixI(values[len(values)-1], compatPrefix+".upper_", perc))
+			result = append(result, proto.WithField(values[len(values)-1], compatPrefix, "upper_"+suffix))
 		}
-		result = append(result, proto.WithValueSuffixI(meanList[len(meanList)-1], compatPrefix+".perc_", perc))
+		result = append(result, proto.WithField(meanList[len(meanList)-1], compatPrefix, "perc_"+suffix))
 	}
 
 	return result
@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBufferFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, shards := range []int{1, 4, 16} {
+		buf := NewShardedBuffer(shards, []int{95}, false)
+		for i := 0; i < 10; i++ {
+			buf.Add(Event{EventType: TypeIncrement, Metric: "hits", Value: 2, Params: []string{"host=a"}})
+			buf.Add(Event{EventType: TypeIncrement, Metric: "hits", Value: 1, Params: []string{"host=b"}})
+			buf.Add(Event{EventType: TypeGauge, Metric: "cpu", Value: int64(i)})
+			buf.Add(Event{EventType: TypeDuration, Metric: "latency", Value: int64(i)})
+		}
+
+		events, received, aggregated := buf.Flush(10)
+		assert.Equal(40, received)
+		assert.Equal(len(events), aggregated)
+
+		values := map[string]int64{}
+		for _, e := range events {
+			values[e.Key()] = e.Value
+		}
+		assert.Equal(int64(20), values["i\thits\thost=a"])
+		assert.Equal(int64(10), values["i\thits\thost=b"])
+		assert.Equal(int64(9), values["g\tcpu\t"])
+		assert.Equal(int64(10), values["d\tlatency.count\t"])
+		assert.Equal(int64(45), values["d\tlatency.sum\t"])
+
+		// Second flush keeps only gauges
+		events, received, _ = buf.Flush(10)
+		assert.Equal(0, received)
+		if assert.Len(events, 1) {
+			assert.Equal("cpu", events[0].Metric)
+		}
+	}
+}
+
+func BenchmarkBufferAdd(b *testing.B) {
+	events := make([]Event, 1024)
+	for i := range events {
+		events[i] = Event{
+			EventType: TypeIncrement,
+			Metric:    fmt.Sprintf("metric.%d", i%64),
+			Value:     1,
+			Params:    []string{fmt.Sprintf("host=host-%d", i/64)},
+		}
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			buf := NewShardedBuffer(shards, nil, false)
+			var offset uint32
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&offset, 97))
+				for pb.Next() {
+					buf.Add(events[i%len(events)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestBufferAddAllocs(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(4, []int{95}, false)
+	counter := Event{EventType: TypeIncrement, Metric: "hits", Value: 1, Params: []string{"host=a", "region=eu"}}
+	timer := []byte("d\tlatency\thost=a")
+
+	// Warming up, so series are registered and durations slice has capacity
+	for i := 0; i < 100; i++ {
+		buf.Add(counter)
+		buf.AddKey(timer, int64(i))
+	}
+	buf.Flush(10)
+	for i := 0; i < 100; i++ {
+		buf.AddKey(timer, int64(i))
+	}
+
+	assert.Zero(testing.AllocsPerRun(100, func() { buf.Add(counter) }))
+	assert.Zero(testing.AllocsPerRun(100, func() { buf.AddKey(timer, 5) }))
+}
+
+func TestBufferUnknownType(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(1, nil, false)
+	buf.AddKey([]byte("x\tgarbage\t"), 1)
+	buf.AddKey([]byte("\tgarbage"), 1)
+	assert.Len(buf.shards[0].series, 0)
+	events, received, _ := buf.Flush(10)
+	assert.Len(events, 0)
+	assert.Zero(received)
+}
+
+func TestEventFromKey(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, e := range []Event{
+		{EventType: TypeIncrement, Metric: "foo"},
+		{EventType: TypeGauge, Metric: "bar", Params: []string{"a=b"}},
+		{EventType: TypeDuration, Metric: "baz", Params: []string{"a=b", "c=d"}},
+	} {
+		assert.Equal(e, EventFromKey(e.Key()))
+	}
+}
+
+func TestBufferSendZeros(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(2, nil, false)
+	buf.SetSendZeros(2)
+	buf.Add(Event{EventType: TypeIncrement, Metric: "errors", Value: 3})
+	buf.Add(Event{EventType: TypeDuration, Metric: "latency", Value: 10})
+
+	keys := func() map[string]int64 {
+		values := map[string]int64{}
+		events, _, _ := buf.Flush(10)
+		for _, e := range events {
+			values[e.Key()] = e.Value
+		}
+		return values
+	}
+
+	values := keys()
+	assert.Equal(int64(3), values["i\terrors\t"])
+	assert.Equal(int64(1), values["d\tlatency.count\t"])
+
+	// Two idle windows report zeros
+	for i := 0; i < 2; i++ {
+		assert.Equal(map[string]int64{"i\terrors\t": 0, "d\tlatency.count\t": 0}, keys())
+	}
+
+	// Then series are forgotten
+	assert.Empty(keys())
+
+	// And registered again on new events
+	buf.Add(Event{EventType: TypeIncrement, Metric: "errors", Value: 1})
+	assert.Equal(map[string]int64{"i\terrors\t": 1}, keys())
+}
+
+func TestBufferEvictIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(2, nil, false)
+	buf.SetEvictIdle(2)
+	size := func() int {
+		n := 0
+		for _, s := range buf.shards {
+			n += len(s.series)
+		}
+		return n
+	}
+
+	for i := 0; i < 100; i++ {
+		buf.Add(Event{EventType: TypeIncrement, Metric: "requests", Params: []string{"id=" + strconv.Itoa(i)}, Value: 1})
+	}
+	buf.Add(Event{EventType: TypeGauge, Metric: "memory", Value: 10})
+	buf.Flush(10)
+	assert.Equal(101, size())
+
+	// Gauge is still reported while idle
+	for i := 0; i < 2; i++ {
+		buf.Add(Event{EventType: TypeIncrement, Metric: "requests", Params: []string{"id=0"}, Value: 1})
+		events, _, _ := buf.Flush(10)
+		assert.Len(events, 2)
+	}
+
+	// Idle series of all types are evicted
+	buf.Flush(10)
+	assert.Equal(1, size())
+}
@@ -12,17 +12,68 @@ const (
 	TypeDuration  byte = 'd'
 )
 
+// TypeName returns human readable name of event type - counter, gauge
+// or timer
+func TypeName(t byte) string {
+	switch t {
+	case TypeIncrement:
+		return "counter"
+	case TypeGauge:
+		return "gauge"
+	case TypeDuration:
+		return "timer"
+	}
+	return "unknown"
+}
+
 // Event used by buffer
 type Event struct {
 	EventType byte
 	Value     int64
 	Metric    string
 	Params    []string
+
+	// Group and Field are filled for aggregated statistics, like timer
+	// percentiles. Group holds original metric name and Field holds
+	// statistic name, for example count or perc_95.
+	Group string
+	Field string
 }
 
 // Key method returns key for hash map
 func (e Event) Key() string {
-	return string(e.EventType) + "\t" + e.Metric + "\t" + strings.Join(e.Params, "\t")
+	return string(e.AppendKey(make([]byte, 0, 64)))
+}
+
+// AppendKey appends hash map key of event to given byte slice and returns
+// extended slice. Key consists of event type, metric name and params, all
+// separated by tab character.
+func (e Event) AppendKey(dst []byte) []byte {
+	dst = append(dst, e.EventType, '\t')
+	dst = append(dst, e.Metric...)
+	dst = append(dst, '\t')
+	for i, p := range e.Params {
+		if i > 0 {
+			dst = append(dst, '\t')
+		}
+		dst = append(dst, p...)
+	}
+	return dst
+}
+
+// EventFromKey builds event from hash map key, produced by Key or AppendKey.
+// Value of resulting event is zero.
+func EventFromKey(key string) Event {
+	if len(key) < 2 {
+		return Event{}
+	}
+	e := Event{EventType: key[0]}
+	chunks := strings.Split(key[2:], "\t")
+	e.Metric = chunks[0]
+	if len(chunks) > 1 && (len(chunks) > 2 || len(chunks[1]) > 0) {
+		e.Params = chunks[1:]
+	}
+	return e
 }
 
 // WithValueSuffix returns new Event with new value and suffix
@@ -35,6 +86,19 @@ func (e Event) WithValueSuffix(value int64, suffix string) Event {
 	}
 }
 
+// WithField returns new Event, holding aggregated statistic with given
+// name. Metric name gets prefix and field name as suffix.
+func (e Event) WithField(value int64, prefix, field string) Event {
+	return Event{
+		EventType: e.EventType,
+		Value:     value,
+		Metric:    e.Metric + prefix + "." + field,
+		Params:    e.Params,
+		Group:     e.Metric,
+		Field:     field,
+	}
+}
+
 // WithValueSuffixI returns new Event with new value and suffix
 func (e Event) WithValueSuffixI(value int64, suffix string, percentile int) Event {
 	return Event{
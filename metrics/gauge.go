@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// GaugeMode defines, how gauge values received within single
+// flush window are aggregated
+type GaugeMode byte
+
+// Gauge aggregation modes
+const (
+	GaugeLast GaugeMode = iota // Last received value, default
+	GaugeMin                   // Minimal value
+	GaugeMax                   // Maximal value
+	GaugeAvg                   // Average value
+	GaugeSum                   // Sum of values
+	GaugeAll                   // All of above, each with own suffix
+)
+
+var gaugeModeNames = map[GaugeMode]string{
+	GaugeLast: "last",
+	GaugeMin:  "min",
+	GaugeMax:  "max",
+	GaugeAvg:  "avg",
+	GaugeSum:  "sum",
+	GaugeAll:  "all",
+}
+
+// String returns name of gauge mode
+func (m GaugeMode) String() string {
+	return gaugeModeNames[m]
+}
+
+// ParseGaugeMode parses gauge mode from its name
+func ParseGaugeMode(s string) (GaugeMode, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for m, name := range gaugeModeNames {
+		if name == s {
+			return m, nil
+		}
+	}
+	return GaugeLast, fmt.Errorf("unknown gauge mode %q", s)
+}
+
+// GaugeRule assigns gauge aggregation mode to metrics
+// with names matching glob pattern
+type GaugeRule struct {
+	Pattern string
+	Mode    GaugeMode
+}
+
+// ParseGaugeRule parses gauge rule in format pattern=mode, for example cpu.*=max
+func ParseGaugeRule(s string) (GaugeRule, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 1 {
+		return GaugeRule{}, fmt.Errorf("gauge rule %q must be in pattern=mode format", s)
+	}
+	pattern := strings.TrimSpace(s[:i])
+	if _, err := path.Match(pattern, ""); err != nil {
+		return GaugeRule{}, fmt.Errorf("invalid gauge rule pattern %q - %s", pattern, err)
+	}
+	mode, err := ParseGaugeMode(s[i+1:])
+	if err != nil {
+		return GaugeRule{}, err
+	}
+	return GaugeRule{Pattern: pattern, Mode: mode}, nil
+}
+
+// Matches returns true if rule pattern matches given metric name
+func (r GaugeRule) Matches(metric string) bool {
+	ok, _ := path.Match(r.Pattern, metric)
+	return ok
+}
+
+// gaugeState holds gauge values, aggregated within window
+type gaugeState struct {
+	last, min, max, sum, count int64
+}
+
+// add registers new gauge value. When window is new, previous
+// aggregated values are discarded.
+func (g *gaugeState) add(value int64, newWindow bool) {
+	if newWindow || g.count == 0 {
+		*g = gaugeState{last: value, min: value, max: value, sum: value, count: 1}
+		return
+	}
+	g.last = value
+	if value < g.min {
+		g.min = value
+	}
+	if value > g.max {
+		g.max = value
+	}
+	g.sum += value
+	g.count++
+}
+
+// value returns aggregated value for given mode
+func (g gaugeState) value(mode GaugeMode) int64 {
+	switch mode {
+	case GaugeMin:
+		return g.min
+	case GaugeMax:
+		return g.max
+	case GaugeAvg:
+		if g.count == 0 {
+			return g.last
+		}
+		return g.sum / g.count
+	case GaugeSum:
+		return g.sum
+	default:
+		return g.last
+	}
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseGaugeRule(t *testing.T) {
+	assert := assert.New(t)
+
+	rule, err := ParseGaugeRule("cpu.*=max")
+	if assert.NoError(err) {
+		assert.Equal(GaugeRule{Pattern: "cpu.*", Mode: GaugeMax}, rule)
+		assert.True(rule.Matches("cpu.user"))
+		assert.False(rule.Matches("memory.used"))
+	}
+
+	_, err = ParseGaugeRule("cpu.*")
+	assert.Error(err)
+	_, err = ParseGaugeRule("cpu.*=median")
+	assert.Error(err)
+	_, err = ParseGaugeRule("cpu.[=max")
+	assert.Error(err)
+}
+
+func TestBufferGaugeModes(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(4, nil, false)
+	buf.SetGaugeModes(GaugeLast, []GaugeRule{
+		{Pattern: "cpu.*", Mode: GaugeMax},
+		{Pattern: "load", Mode: GaugeAvg},
+		{Pattern: "queue", Mode: GaugeAll},
+	})
+	for _, v := range []int64{5, 9, 1} {
+		for _, name := range []string{"cpu.user", "load", "queue", "memory"} {
+			buf.Add(Event{EventType: TypeGauge, Metric: name, Value: v})
+		}
+	}
+
+	values := map[string]int64{}
+	events, _, _ := buf.Flush(10)
+	for _, e := range events {
+		values[e.Metric] = e.Value
+	}
+	assert.Equal(map[string]int64{
+		"cpu.user":   9,
+		"load":       5,
+		"memory":     1,
+		"queue.last": 1,
+		"queue.min":  1,
+		"queue.max":  9,
+		"queue.avg":  5,
+		"queue.sum":  15,
+	}, values)
+
+	// New window discards previous aggregation, idle gauges keep values
+	buf.Add(Event{EventType: TypeGauge, Metric: "cpu.user", Value: 2})
+	values = map[string]int64{}
+	events, _, _ = buf.Flush(10)
+	for _, e := range events {
+		values[e.Metric] = e.Value
+	}
+	assert.Equal(int64(2), values["cpu.user"])
+	assert.Equal(int64(5), values["load"])
+}
+
+func TestBufferGaugeSumIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(1, nil, false)
+	buf.SetGaugeModes(GaugeSum, []GaugeRule{{Pattern: "queue", Mode: GaugeAll}})
+	for _, v := range []int64{5, 9} {
+		buf.Add(Event{EventType: TypeGauge, Metric: "bytes", Value: v})
+		buf.Add(Event{EventType: TypeGauge, Metric: "queue", Value: v})
+	}
+	buf.Flush(10)
+
+	// Idle windows report zero sum, other values are kept
+	for i := 0; i < 2; i++ {
+		values := map[string]int64{}
+		events, _, _ := buf.Flush(10)
+		for _, e := range events {
+			values[e.Metric] = e.Value
+		}
+		assert.Equal(map[string]int64{
+			"bytes":      0,
+			"queue.last": 9,
+			"queue.min":  5,
+			"queue.max":  9,
+			"queue.avg":  7,
+			"queue.sum":  0,
+		}, values)
+	}
+}
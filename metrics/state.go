@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateVersion is current version of buffer state format
+const StateVersion = 1
+
+// ErrStateCorrupted is returned when state checksum does not match its contents
+var ErrStateCorrupted = errors.New("buffer state checksum mismatch")
+
+// stateEnvelope is top level structure of state file. Payload is kept raw,
+// so checksum can be verified before payload is decoded.
+type stateEnvelope struct {
+	Version  int             `json:"version"`
+	Checksum uint32          `json:"checksum"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type statePayload struct {
+	Time   int64         `json:"time"`
+	Series []stateSeries `json:"series"`
+}
+
+type stateSeries struct {
+	Key    string  `json:"key"`
+	Value  int64   `json:"value,omitempty"`
+	Values []int64 `json:"values,omitempty"`
+}
+
+// Snapshot writes buffer state into given writer. Gauges are always
+// written, counters and durations of current window only when
+// withCounters is true.
+func (b *Buffer) Snapshot(w io.Writer, withCounters bool) error {
+	payload := statePayload{Time: time.Now().Unix(), Series: []stateSeries{}}
+	for _, s := range b.shards {
+		s.lock.Lock()
+		for k, se := range s.series {
+			switch se.proto.EventType {
+			case TypeGauge:
+				payload.Series = append(payload.Series, stateSeries{Key: k, Value: se.gauge.value(se.gaugeMode)})
+			case TypeIncrement:
+				if withCounters && se.active {
+					payload.Series = append(payload.Series, stateSeries{Key: k, Value: se.value})
+				}
+			case TypeDuration:
+				if withCounters && se.active {
+					payload.Series = append(payload.Series, stateSeries{Key: k, Values: append([]int64(nil), se.values...)})
+				}
+			}
+		}
+		s.lock.Unlock()
+	}
+
+	bts, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(stateEnvelope{
+		Version:  StateVersion,
+		Checksum: crc32.ChecksumIEEE(bts),
+		Payload:  bts,
+	})
+}
+
+// SetStateMaxAge configures max age of restored counters and durations.
+// Snapshot older than flush window was likely taken before flush, that
+// already sent them, so only its gauges are restored. Zero means no limit.
+func (b *Buffer) SetStateMaxAge(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	b.stateMaxAge = d
+}
+
+// Restore reads buffer state, written by Snapshot, and merges it into
+// buffer. Returns amount of restored series.
+func (b *Buffer) Restore(r io.Reader) (int, error) {
+	var env stateEnvelope
+	if err := json.NewDecoder(r).Decode(&env); err != nil {
+		return 0, err
+	}
+	if env.Version != StateVersion {
+		return 0, fmt.Errorf("unsupported buffer state version %d", env.Version)
+	}
+	if crc32.ChecksumIEEE(env.Payload) != env.Checksum {
+		return 0, ErrStateCorrupted
+	}
+
+	var payload statePayload
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return 0, err
+	}
+	stale := b.stateMaxAge > 0 && time.Now().Sub(time.Unix(payload.Time, 0)) > b.stateMaxAge
+
+	count := 0
+	for _, ss := range payload.Series {
+		key := []byte(ss.Key)
+		if len(key) < 2 || (stale && key[0] != TypeGauge) {
+			continue
+		}
+
+		s := b.shardFor(key)
+		s.lock.Lock()
+		se, ok := s.series[ss.Key]
+		if !ok {
+			se = b.newSeries(EventFromKey(ss.Key))
+			s.series[ss.Key] = se
+		}
+		switch key[0] {
+		case TypeGauge:
+			se.gauge.add(ss.Value, true)
+		case TypeIncrement:
+			se.value += ss.Value
+			se.active = true
+		case TypeDuration:
+			se.values = append(se.values, ss.Values...)
+			se.active = len(se.values) > 0
+		}
+		s.lock.Unlock()
+		count++
+	}
+
+	return count, nil
+}
+
+// SaveState writes buffer state into file with given name. File is
+// replaced atomically, so crash during write does not corrupt previous state.
+func (b *Buffer) SaveState(name string, withCounters bool) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := b.Snapshot(f, withCounters); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// LoadState restores buffer state from file with given name.
+// Returns amount of restored series.
+func (b *Buffer) LoadState(name string) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return b.Restore(f)
+}
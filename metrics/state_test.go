@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferStateRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(4, nil, false)
+	buf.Add(Event{EventType: TypeGauge, Metric: "cpu", Value: 80, Params: []string{"host=a"}})
+	buf.Add(Event{EventType: TypeIncrement, Metric: "hits", Value: 3})
+	buf.Add(Event{EventType: TypeDuration, Metric: "latency", Value: 7})
+
+	dir, err := ioutil.TempDir("", "dogrelay")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "state.json")
+
+	// Gauges only
+	if assert.NoError(buf.SaveState(name, false)) {
+		restored := NewShardedBuffer(2, nil, false)
+		count, err := restored.LoadState(name)
+		if assert.NoError(err) {
+			assert.Equal(1, count)
+			events, _, _ := restored.Flush(10)
+			if assert.Len(events, 1) {
+				assert.Equal("g\tcpu\thost=a", events[0].Key())
+				assert.Equal(int64(80), events[0].Value)
+			}
+		}
+	}
+
+	// With in-window counters and durations
+	if assert.NoError(buf.SaveState(name, true)) {
+		restored := NewShardedBuffer(2, nil, false)
+		count, err := restored.LoadState(name)
+		if assert.NoError(err) {
+			assert.Equal(3, count)
+			events, _, _ := restored.Flush(10)
+			values := map[string]int64{}
+			for _, e := range events {
+				values[e.Key()] = e.Value
+			}
+			assert.Equal(int64(3), values["i\thits\t"])
+			assert.Equal(int64(1), values["d\tlatency.count\t"])
+		}
+	}
+}
+
+func TestBufferStateCorruption(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := NewShardedBuffer(1, nil, false)
+	buf.Add(Event{EventType: TypeGauge, Metric: "cpu", Value: 80})
+
+	var out bytes.Buffer
+	if assert.NoError(buf.Snapshot(&out, false)) {
+		corrupted := bytes.Replace(out.Bytes(), []byte("cpu"), []byte("cpx"), 1)
+		_, err := NewBuffer(nil, false).Restore(bytes.NewReader(corrupted))
+		assert.Equal(ErrStateCorrupted, err)
+
+		_, err = NewBuffer(nil, false).Restore(bytes.NewReader(out.Bytes()[:out.Len()/2]))
+		assert.Error(err)
+
+		unsupported := bytes.Replace(out.Bytes(), []byte(`"version":1`), []byte(`"version":2`), 1)
+		_, err = NewBuffer(nil, false).Restore(bytes.NewReader(unsupported))
+		assert.Error(err)
+	}
+}
+
+func TestBufferStateStale(t *testing.T) {
+	assert := assert.New(t)
+
+	payload, _ := json.Marshal(statePayload{
+		Time: time.Now().Add(-time.Minute).Unix(),
+		Series: []stateSeries{
+			{Key: "g\tcpu\t", Value: 80},
+			{Key: "i\thits\t", Value: 3},
+			{Key: "d\tlatency\t", Values: []int64{7}},
+		},
+	})
+	var state bytes.Buffer
+	assert.NoError(json.NewEncoder(&state).Encode(stateEnvelope{
+		Version:  StateVersion,
+		Checksum: crc32.ChecksumIEEE(payload),
+		Payload:  payload,
+	}))
+
+	// Counters and durations of stale snapshot were likely flushed already
+	buf := NewShardedBuffer(1, nil, false)
+	buf.SetStateMaxAge(10 * time.Second)
+	count, err := buf.Restore(bytes.NewReader(state.Bytes()))
+	assert.NoError(err)
+	assert.Equal(1, count)
+	events, _, _ := buf.Flush(10)
+	if assert.Len(events, 1) {
+		assert.Equal("g\tcpu\t", events[0].Key())
+	}
+
+	// No limit
+	buf = NewShardedBuffer(1, nil, false)
+	count, err = buf.Restore(bytes.NewReader(state.Bytes()))
+	assert.NoError(err)
+	assert.Equal(3, count)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import "time"
+
+// Ticker delivers flush windows of fixed interval, aligned to interval
+// boundaries. Window is delivered when it ends and is stamped with its
+// start. Stamps only grow, so consecutive flushes never share timestamp,
+// even when ticks are delayed.
+type Ticker struct {
+	C    <-chan time.Time
+	stop chan struct{}
+}
+
+// NewTicker starts new window ticker with given interval
+func NewTicker(interval time.Duration) *Ticker {
+	c := make(chan time.Time)
+	t := &Ticker{C: c, stop: make(chan struct{})}
+	go t.run(c, interval)
+	return t
+}
+
+// Stop stops ticker, no more windows are delivered
+func (t *Ticker) Stop() {
+	close(t.stop)
+}
+
+func (t *Ticker) run(c chan<- time.Time, interval time.Duration) {
+	start := time.Now().Truncate(interval)
+	for {
+		timer := time.NewTimer(time.Until(start.Add(interval)))
+		select {
+		case <-t.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select {
+		case c <- start:
+		case <-t.stop:
+			return
+		}
+
+		// Next window ends on next boundary, windows, missed because of
+		// slow receiver, are merged into it
+		next := time.Now().Truncate(interval)
+		if !next.After(start) {
+			next = start.Add(interval)
+		}
+		start = next
+	}
+}
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTicker(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := 20 * time.Millisecond
+	ticker := NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev time.Time
+	for i := 0; i < 10; i++ {
+		window := <-ticker.C
+		assert.Equal(window, window.Truncate(interval))
+		assert.False(time.Now().Before(window.Add(interval)))
+		if i > 0 {
+			assert.True(window.After(prev), "%s is not after %s", window, prev)
+		}
+		prev = window
+
+		if i == 5 {
+			// Slow receiver, windows are merged, but stamps still grow
+			time.Sleep(3 * interval)
+		}
+	}
+}
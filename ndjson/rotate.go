@@ -0,0 +1,103 @@
+package ndjson
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// RotatingFile is file writer, that renames file to name.1 when it
+// grows over max size, shifting older files to name.2, name.3 and so on.
+// Files over max amount are removed. Data of single Write is never split
+// between files. Failed rotation keeps current file open, so data is still
+// appended to it.
+type RotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	m    sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens or creates file for appending. Zero max size
+// disables rotation, zero max files means rotated files are not kept.
+func OpenRotatingFile(name string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	f, size, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &RotatingFile{name: name, maxSize: maxSize, maxFiles: maxFiles, file: f, size: size}, nil
+}
+
+func openFile(name string) (*os.File, int64, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+// Write is io.Writer implementation. When rotation fails, data is
+// written to current file and rotation error is returned.
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		rotateErr = r.rotate()
+	}
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts rotated files and replaces current file with new one.
+// Current file is closed only after new one is opened.
+func (r *RotatingFile) rotate() error {
+	if r.maxFiles <= 0 {
+		if err := r.file.Truncate(0); err != nil {
+			return err
+		}
+		r.size = 0
+		return nil
+	}
+
+	_ = os.Remove(r.name + "." + strconv.Itoa(r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		from := r.name + "." + strconv.Itoa(i)
+		if err := os.Rename(from, r.name+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.name, r.name+".1"); err != nil {
+		return err
+	}
+	f, size, err := openFile(r.name)
+	if err != nil {
+		// Current file gets its name back
+		_ = os.Rename(r.name+".1", r.name)
+		return err
+	}
+
+	old := r.file
+	r.file, r.size = f, size
+	return old.Close()
+}
+
+// Close closes current file
+func (r *RotatingFile) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,87 @@
+package ndjson
+
+import (
+	"encoding/json"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is single flushed event in NDJSON output
+type Record struct {
+	Name      string            `json:"name"`
+	Tags      map[string]string `json:"tags"`
+	Type      string            `json:"type"`
+	Value     int64             `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// NewRecord converts event, flushed at given time, into record. Params
+// without value become tags with empty value.
+func NewRecord(ts time.Time, e metrics.Event) Record {
+	r := Record{
+		Name:      e.Metric,
+		Tags:      make(map[string]string, len(e.Params)),
+		Type:      metrics.TypeName(e.EventType),
+		Value:     e.Value,
+		Timestamp: ts.Unix(),
+	}
+	for _, p := range e.Params {
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			r.Tags[p[:i]] = p[i+1:]
+		} else {
+			r.Tags[p] = ""
+		}
+	}
+	return r
+}
+
+// Writer writes flushed events as newline delimited JSON, one record
+// per line. Every flush is written with single Write call, so lines of
+// concurrent flushes are not interleaved.
+type Writer struct {
+	log xray.Ray
+
+	m   sync.Mutex
+	out io.Writer
+}
+
+// NewWriter builds NDJSON writer over given output, like os.Stdout
+// or RotatingFile
+func NewWriter(out io.Writer) *Writer {
+	return &Writer{
+		out: out,
+		log: xray.ROOT.Fork().WithLogger("ndjson").WithMetricPrefix("ndjson"),
+	}
+}
+
+// Write encodes events, flushed at given time, and writes them to output
+func (w *Writer) Write(ts time.Time, events []metrics.Event) error {
+	var body []byte
+	for _, e := range events {
+		bts, err := json.Marshal(NewRecord(ts, e))
+		if err != nil {
+			w.log.Inc("error", args.Type("encode"))
+			continue
+		}
+		body = append(body, bts...)
+		body = append(body, '\n')
+	}
+	if len(body) == 0 {
+		return nil
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, err := w.out.Write(body); err != nil {
+		w.log.Inc("error", args.Type("io"))
+		w.log.Error("Unable to write :count records - :err", args.Count(len(events)), args.Error{Err: err})
+		return err
+	}
+	w.log.Increment("records", int64(len(events)))
+	return nil
+}
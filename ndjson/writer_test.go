@@ -0,0 +1,132 @@
+package ndjson
+
+import (
+	"bytes"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	assert.NoError(t, w.Write(time.Unix(100, 0), []metrics.Event{
+		{EventType: metrics.TypeIncrement, Metric: "api.hits", Value: 3, Params: []string{"host=a", "canary"}},
+		{EventType: metrics.TypeGauge, Metric: "cpu\t\"load\"", Value: -1},
+	}))
+	assert.Equal(
+		t,
+		`{"name":"api.hits","tags":{"canary":"","host":"a"},"type":"counter","value":3,"timestamp":100}`+"\n"+
+			`{"name":"cpu\t\"load\"","tags":{},"type":"gauge","value":-1,"timestamp":100}`+"\n",
+		buf.String(),
+	)
+}
+
+func TestRotatingFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ndjson")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "flush.ndjson")
+
+	f, err := OpenRotatingFile(name, 10, 2)
+	if !assert.NoError(err) {
+		return
+	}
+	for _, chunk := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeeeeeeeeeee\n", "ffff\n"} {
+		_, err := f.Write([]byte(chunk))
+		assert.NoError(err)
+	}
+	assert.NoError(f.Close())
+
+	read := func(name string) string {
+		bts, _ := ioutil.ReadFile(name)
+		return string(bts)
+	}
+	assert.Equal("ffff\n", read(name))
+	assert.Equal("eeeeeeeeeeee\n", read(name+".1"))
+	assert.Equal("cccc\ndddd\n", read(name+".2"))
+	_, err = os.Stat(name + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// Reopened file continues with existing size
+	f, err = OpenRotatingFile(name, 10, 2)
+	if assert.NoError(err) {
+		_, _ = f.Write([]byte("gggg\n"))
+		_, _ = f.Write([]byte("hhhh\n"))
+		assert.NoError(f.Close())
+		assert.Equal("hhhh\n", read(name))
+		assert.Equal("ffff\ngggg\n", read(name+".1"))
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ndjson")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "flush.ndjson")
+
+	// Non empty directory in place of rotated file can not be replaced,
+	// regardless of permissions
+	assert.NoError(os.MkdirAll(filepath.Join(name+".1", "blocker"), 0755))
+
+	f, err := OpenRotatingFile(name, 10, 1)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = f.Write([]byte("aaaa\n"))
+	assert.NoError(err)
+	n, err := f.Write([]byte("bbbbbbbb\n"))
+	assert.Error(err)
+	assert.Equal(9, n)
+
+	// Writer stays usable and rotates once obstacle is gone
+	assert.NoError(os.RemoveAll(name + ".1"))
+	_, err = f.Write([]byte("cccc\n"))
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	read := func(name string) string {
+		bts, _ := ioutil.ReadFile(name)
+		return string(bts)
+	}
+	assert.Equal("cccc\n", read(name))
+	assert.Equal("aaaa\nbbbbbbbb\n", read(name+".1"))
+}
+
+func TestRotatingFileTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ndjson")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "flush.ndjson")
+
+	f, err := OpenRotatingFile(name, 10, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	for _, chunk := range []string{"aaaa\n", "bbbb\n", "cccc\n"} {
+		_, err := f.Write([]byte(chunk))
+		assert.NoError(err)
+	}
+	assert.NoError(f.Close())
+
+	bts, _ := ioutil.ReadFile(name)
+	assert.Equal("cccc\n", string(bts))
+	_, err = os.Stat(name + ".1")
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,161 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/dogrelay/transport"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Config contains OpenTSDB HTTP API settings
+type Config struct {
+	URL          string            // Base URL, like http://localhost:4242
+	APIKey       string            // API key, sent in APIKeyHeader, for authenticating proxies
+	APIKeyHeader string            // Header name for API key, X-Api-Key by default
+	Tags         map[string]string // Tags, added to every data point
+	BatchSize    int               // Max data points in single request
+	Timeout      time.Duration     // Single request timeout
+	MaxRetries   int               // Retries of failed request
+	Backoff      time.Duration     // Delay before first retry
+	Gzip         bool              // Compress batches
+}
+
+// Default tag is added to data points without tags, because OpenTSDB
+// requires at least one tag
+const (
+	DefaultTagName  = "source"
+	DefaultTagValue = "dogrelay"
+)
+
+// Writer sends flushed metrics to OpenTSDB /api/put endpoint
+type Writer struct {
+	url       string
+	header    http.Header
+	tags      map[string]string
+	batchSize int
+	http      *transport.HTTP
+	log       xray.Ray
+}
+
+type dataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     int64             `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// NewWriter builds new OpenTSDB writer
+func NewWriter(cfg Config) (*Writer, error) {
+	if len(cfg.URL) == 0 {
+		return nil, errors.New("empty OpenTSDB URL")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 50
+	}
+	if len(cfg.APIKeyHeader) == 0 {
+		cfg.APIKeyHeader = "X-Api-Key"
+	}
+
+	w := &Writer{
+		url:       strings.TrimRight(cfg.URL, "/") + "/api/put",
+		header:    http.Header{},
+		tags:      map[string]string{},
+		batchSize: cfg.BatchSize,
+		http:      transport.NewHTTP(cfg.Timeout, cfg.MaxRetries, cfg.Backoff, cfg.Gzip),
+		log:       xray.ROOT.Fork().WithLogger("opentsdb").WithMetricPrefix("opentsdb"),
+	}
+	w.header.Set("Content-Type", "application/json")
+	if len(cfg.APIKey) > 0 {
+		w.header.Set(cfg.APIKeyHeader, cfg.APIKey)
+	}
+	for k, v := range cfg.Tags {
+		w.tags[Sanitize(k)] = Sanitize(v)
+	}
+
+	return w, nil
+}
+
+// Write sends events, flushed at given time, to OpenTSDB in batches.
+// First error is returned after all batches are processed.
+func (w *Writer) Write(ts time.Time, events []metrics.Event) error {
+	var first error
+	points := make([]dataPoint, 0, w.batchSize)
+	send := func() {
+		before := time.Now()
+		body, err := json.Marshal(points)
+		if err == nil {
+			err = w.http.Post(w.url, w.header, body)
+		}
+		w.log.Duration("latency", time.Now().Sub(before))
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			w.log.Error("Unable to put :count data points to OpenTSDB - :err", args.Count(len(points)), args.Error{Err: err})
+			w.log.Inc("error", args.Type(transport.ErrorType(err)))
+		} else {
+			w.log.Inc("success")
+			w.log.Increment("points", int64(len(points)))
+		}
+		points = points[:0]
+	}
+
+	for _, e := range events {
+		points = append(points, w.dataPoint(ts, e))
+		if len(points) >= w.batchSize {
+			send()
+		}
+	}
+	if len(points) > 0 {
+		send()
+	}
+
+	return first
+}
+
+// dataPoint converts event into OpenTSDB data point. Params without
+// value become tags with value "true".
+func (w *Writer) dataPoint(ts time.Time, e metrics.Event) dataPoint {
+	tags := make(map[string]string, len(w.tags)+len(e.Params))
+	for k, v := range w.tags {
+		tags[k] = v
+	}
+	for _, p := range e.Params {
+		if i := strings.IndexByte(p, '='); i > 0 {
+			if i < len(p)-1 {
+				tags[Sanitize(p[:i])] = Sanitize(p[i+1:])
+			}
+		} else if len(p) > 0 {
+			tags[Sanitize(p)] = "true"
+		}
+	}
+	if len(tags) == 0 {
+		tags[DefaultTagName] = DefaultTagValue
+	}
+
+	return dataPoint{
+		Metric:    Sanitize(e.Metric),
+		Timestamp: ts.Unix(),
+		Value:     e.Value,
+		Tags:      tags,
+	}
+}
+
+// Sanitize replaces characters, not allowed by OpenTSDB in metric names
+// and tags, with underscores
+func Sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == '/':
+		default:
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,62 @@
+package opentsdb
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var batches [][]dataPoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/api/put", r.URL.Path)
+		assert.Equal("secret", r.Header.Get("X-Api-Key"))
+		assert.Equal("gzip", r.Header.Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(r.Body)
+		if assert.NoError(err) {
+			var points []dataPoint
+			assert.NoError(json.NewDecoder(gz).Decode(&points))
+			batches = append(batches, points)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w, err := NewWriter(Config{URL: server.URL + "/", APIKey: "secret", BatchSize: 2, Gzip: true})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(w.Write(time.Unix(100, 0), []metrics.Event{
+		{Metric: "api.hits", Value: 1, Params: []string{"host=a b", "canary"}},
+		{Metric: "cpu:load", Value: 2},
+		{Metric: "mem", Value: 3, Params: []string{"empty="}},
+	}))
+
+	assert.Equal([][]dataPoint{
+		{
+			{Metric: "api.hits", Timestamp: 100, Value: 1, Tags: map[string]string{"host": "a_b", "canary": "true"}},
+			{Metric: "cpu_load", Timestamp: 100, Value: 2, Tags: map[string]string{"source": "dogrelay"}},
+		},
+		{
+			{Metric: "mem", Timestamp: 100, Value: 3, Tags: map[string]string{"source": "dogrelay"}},
+		},
+	}, batches)
+}
+
+func TestWriterRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	w, _ := NewWriter(Config{URL: server.URL, MaxRetries: 3})
+	assert.Error(t, w.Write(time.Unix(100, 0), []metrics.Event{{Metric: "a", Value: 1}}))
+}
@@ -0,0 +1,258 @@
+package prometheus
+
+import (
+	"bytes"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric types
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+	typeSummary = "summary"
+)
+
+// Exporter consumes flushed metrics and serves them in Prometheus text
+// exposition format, like statsd_exporter does. Counters and summary
+// sums and counts are accumulated, gauges and quantiles hold values of
+// last flush window.
+type Exporter struct {
+	mappings []Mapping
+	ttl      time.Duration
+	log      xray.Ray
+
+	m        sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name   string
+	typ    string
+	series map[string]*series
+}
+
+type series struct {
+	labels    string // Rendered labels without braces
+	value     int64
+	sum       int64
+	count     int64
+	quantiles map[string]int64
+	updated   time.Time
+}
+
+// NewExporter builds new Prometheus exporter with given mapping rules.
+// Series, not updated during ttl, are removed. Zero ttl disables expiration.
+func NewExporter(mappings []Mapping, ttl time.Duration) *Exporter {
+	return &Exporter{
+		mappings: mappings,
+		ttl:      ttl,
+		log:      xray.ROOT.Fork().WithLogger("prometheus").WithMetricPrefix("prometheus"),
+		families: map[string]*family{},
+	}
+}
+
+// Write registers events, flushed at given time
+func (e *Exporter) Write(ts time.Time, events []metrics.Event) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	for _, ev := range events {
+		switch {
+		case ev.EventType == metrics.TypeIncrement:
+			if s := e.series(ev.Metric, ev.Params, typeCounter, ts); s != nil {
+				s.value += ev.Value
+			}
+		case ev.EventType == metrics.TypeGauge:
+			if s := e.series(ev.Metric, ev.Params, typeGauge, ts); s != nil {
+				s.value = ev.Value
+			}
+		case ev.EventType == metrics.TypeDuration && len(ev.Group) > 0:
+			s := e.series(ev.Group, ev.Params, typeSummary, ts)
+			if s == nil {
+				continue
+			}
+			switch {
+			case ev.Field == "count":
+				s.count += ev.Value
+			case ev.Field == "sum":
+				s.sum += ev.Value
+			case strings.HasPrefix(ev.Field, "perc_"):
+				if perc, err := strconv.Atoi(ev.Field[5:]); err == nil {
+					s.quantiles[strconv.FormatFloat(float64(perc)/100, 'f', -1, 64)] = ev.Value
+				}
+			}
+		}
+	}
+
+	if e.ttl > 0 {
+		for name, f := range e.families {
+			for k, s := range f.series {
+				if ts.Sub(s.updated) > e.ttl {
+					delete(f.series, k)
+				}
+			}
+			if len(f.series) == 0 {
+				delete(e.families, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// series returns series for given metric, creating it if needed.
+// Returns nil if metric name is already used by family of other type.
+func (e *Exporter) series(metric string, params []string, typ string, ts time.Time) *series {
+	name, labels := e.mapName(metric)
+	for _, p := range params {
+		if i := strings.IndexByte(p, '='); i > 0 {
+			k := SanitizeLabel(p[:i])
+			if _, ok := labels[k]; !ok {
+				labels[k] = p[i+1:]
+			}
+		}
+	}
+
+	f, ok := e.families[name]
+	if !ok {
+		f = &family{name: name, typ: typ, series: map[string]*series{}}
+		e.families[name] = f
+	} else if f.typ != typ {
+		e.log.Inc("conflict")
+		return nil
+	}
+
+	rendered := renderLabels(labels)
+	s, ok := f.series[rendered]
+	if !ok {
+		s = &series{labels: rendered}
+		if typ == typeSummary {
+			s.quantiles = map[string]int64{}
+		}
+		f.series[rendered] = s
+	}
+	s.updated = ts
+	return s
+}
+
+// mapName applies first matching mapping to metric name
+func (e *Exporter) mapName(metric string) (string, map[string]string) {
+	for _, m := range e.mappings {
+		if name, labels, ok := m.Match(metric); ok {
+			sanitized := make(map[string]string, len(labels))
+			for k, v := range labels {
+				sanitized[SanitizeLabel(k)] = v
+			}
+			return SanitizeName(name), sanitized
+		}
+	}
+	return SanitizeName(metric), map[string]string{}
+}
+
+// renderLabels renders sorted labels in exposition format without braces
+func renderLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+// ServeHTTP is http.Handler implementation, serving metrics
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(e.Render())
+}
+
+// Render returns all metrics in Prometheus text exposition format
+func (e *Exporter) Render() []byte {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	names := make([]string, 0, len(e.families))
+	for name := range e.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := e.families[name]
+		buf.WriteString("# TYPE " + name + " " + f.typ + "\n")
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.typ != typeSummary {
+				writeSample(&buf, name, s.labels, "", s.value)
+				continue
+			}
+
+			quantiles := make([]string, 0, len(s.quantiles))
+			for q := range s.quantiles {
+				quantiles = append(quantiles, q)
+			}
+			sort.Strings(quantiles)
+			for _, q := range quantiles {
+				writeSample(&buf, name, s.labels, `quantile="`+q+`"`, s.quantiles[q])
+			}
+			writeSample(&buf, name+"_sum", s.labels, "", s.sum)
+			writeSample(&buf, name+"_count", s.labels, "", s.count)
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeSample(buf *bytes.Buffer, name, labels, extra string, value int64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || len(extra) > 0 {
+		buf.WriteByte('{')
+		buf.WriteString(labels)
+		if len(labels) > 0 && len(extra) > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(extra)
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(value, 10))
+	buf.WriteByte('\n')
+}
+
+// ListenAndServe starts HTTP server with exporter on /metrics
+func (e *Exporter) ListenAndServe(bind string) error {
+	xray.BOOT.Info("Serving aggregated metrics for Prometheus at :addr/metrics", args.Addr(bind))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	return http.ListenAndServe(bind, mux)
+}
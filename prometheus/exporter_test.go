@@ -0,0 +1,88 @@
+package prometheus
+
+import (
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := ParseMapping("test.dispatcher.*.*=dispatcher_$2,processor=$1,action=$2")
+	if assert.NoError(err) {
+		name, labels, ok := m.Match("test.dispatcher.FooProcessor.send")
+		assert.True(ok)
+		assert.Equal("dispatcher_send", name)
+		assert.Equal(map[string]string{"processor": "FooProcessor", "action": "send"}, labels)
+
+		_, _, ok = m.Match("test.dispatcher.FooProcessor")
+		assert.False(ok)
+		_, _, ok = m.Match("test.other.FooProcessor.send")
+		assert.False(ok)
+	}
+
+	_, err = ParseMapping("test.*")
+	assert.Error(err)
+	_, err = ParseMapping("test.*=name,label")
+	assert.Error(err)
+}
+
+func TestSanitize(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("http_requests_total", SanitizeName("http.requests-total"))
+	assert.Equal("_5xx:rate", SanitizeName("5xx:rate"))
+	assert.Equal("a_b", SanitizeLabel("a:b"))
+	assert.Equal("_", SanitizeLabel(""))
+}
+
+func TestExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	m, _ := ParseMapping("api.*.hits=api_hits,endpoint=$1")
+	exp := NewExporter([]Mapping{m}, 0)
+
+	write := func() {
+		buf := metrics.NewShardedBuffer(1, []int{95}, false)
+		buf.Add(metrics.Event{EventType: metrics.TypeIncrement, Metric: "api.users.hits", Value: 2, Params: []string{"host=a"}})
+		buf.Add(metrics.Event{EventType: metrics.TypeGauge, Metric: "cpu.load", Value: 7, Params: []string{"path=\"x\""}})
+		buf.Add(metrics.Event{EventType: metrics.TypeDuration, Metric: "db.latency", Value: 10})
+		buf.Add(metrics.Event{EventType: metrics.TypeDuration, Metric: "db.latency", Value: 20})
+		events, _, _ := buf.Flush(10)
+		assert.NoError(exp.Write(time.Now(), events))
+	}
+	write()
+	write()
+
+	server := httptest.NewServer(exp)
+	defer server.Close()
+	res, err := server.Client().Get(server.URL)
+	if assert.NoError(err) {
+		body, _ := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.Equal("text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"))
+		assert.Equal(`# TYPE api_hits counter
+api_hits{endpoint="users",host="a"} 4
+# TYPE cpu_load gauge
+cpu_load{path="\"x\""} 7
+# TYPE db_latency summary
+db_latency{quantile="0.95"} 20
+db_latency_sum 60
+db_latency_count 4
+`, string(body))
+	}
+}
+
+func TestExporterTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	exp := NewExporter(nil, time.Minute)
+	now := time.Now()
+	assert.NoError(exp.Write(now, []metrics.Event{{EventType: metrics.TypeGauge, Metric: "old", Value: 1}}))
+	assert.NoError(exp.Write(now.Add(2*time.Minute), []metrics.Event{{EventType: metrics.TypeGauge, Metric: "new", Value: 1}}))
+	assert.Equal("# TYPE new gauge\nnew 1\n", string(exp.Render()))
+}
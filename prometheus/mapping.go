@@ -0,0 +1,128 @@
+package prometheus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mapping converts dotted StatsD metric names into Prometheus metric
+// names and labels. Pattern segments are separated by dots, asterisk
+// matches exactly one segment and matched segments are available in
+// name and label values as $1, $2 and so on.
+type Mapping struct {
+	Pattern string
+	Name    string
+	Labels  map[string]string
+
+	segments []string
+}
+
+// ParseMapping parses mapping in format pattern=name,label=value,...
+// for example test.dispatcher.*.*=dispatcher_events,processor=$1,action=$2
+func ParseMapping(s string) (Mapping, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 1 {
+		return Mapping{}, fmt.Errorf("mapping %q must be in pattern=name,label=value format", s)
+	}
+
+	chunks := strings.Split(s[i+1:], ",")
+	m := Mapping{
+		Pattern: strings.TrimSpace(s[:i]),
+		Name:    strings.TrimSpace(chunks[0]),
+		Labels:  map[string]string{},
+	}
+	if len(m.Name) == 0 {
+		return Mapping{}, fmt.Errorf("empty metric name in mapping %q", s)
+	}
+	for _, chunk := range chunks[1:] {
+		j := strings.IndexByte(chunk, '=')
+		if j < 1 {
+			return Mapping{}, fmt.Errorf("invalid label %q in mapping %q", chunk, s)
+		}
+		m.Labels[strings.TrimSpace(chunk[:j])] = strings.TrimSpace(chunk[j+1:])
+	}
+	m.segments = strings.Split(m.Pattern, ".")
+	return m, nil
+}
+
+// Match matches given metric name against mapping pattern and returns
+// mapped name and labels on success
+func (m Mapping) Match(metric string) (string, map[string]string, bool) {
+	if m.segments == nil {
+		m.segments = strings.Split(m.Pattern, ".")
+	}
+	parts := strings.Split(metric, ".")
+	if len(parts) != len(m.segments) {
+		return "", nil, false
+	}
+
+	var captures []string
+	for i, seg := range m.segments {
+		if seg == "*" {
+			captures = append(captures, parts[i])
+		} else if seg != parts[i] {
+			return "", nil, false
+		}
+	}
+
+	labels := make(map[string]string, len(m.Labels))
+	for k, v := range m.Labels {
+		labels[k] = expand(v, captures)
+	}
+	return expand(m.Name, captures), labels, true
+}
+
+// expand replaces $N placeholders with captured segments
+func expand(s string, captures []string) string {
+	if strings.IndexByte(s, '$') < 0 {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '$' {
+			j := i + 1
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			if n, err := strconv.Atoi(s[i+1 : j]); err == nil && n >= 1 && n <= len(captures) {
+				b.WriteString(captures[n-1])
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// SanitizeName converts given string into valid Prometheus metric name
+func SanitizeName(s string) string {
+	return sanitize(s, true)
+}
+
+// SanitizeLabel converts given string into valid Prometheus label name
+func SanitizeLabel(s string) string {
+	return sanitize(s, false)
+}
+
+func sanitize(s string, colon bool) string {
+	if len(s) == 0 {
+		return "_"
+	}
+
+	b := make([]byte, 0, len(s)+1)
+	if s[0] >= '0' && s[0] <= '9' {
+		b = append(b, '_')
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || colon && c == ':' {
+			b = append(b, c)
+		} else {
+			b = append(b, '_')
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,85 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protobuf encoding of Prometheus remote write WriteRequest message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// label is single time series label
+type label struct {
+	Name, Value string
+}
+
+// timeSeries is single time series with one sample
+type timeSeries struct {
+	Labels    []label
+	Value     float64
+	Timestamp int64 // Milliseconds
+}
+
+// marshalWriteRequest encodes time series into WriteRequest message
+func marshalWriteRequest(dst []byte, series []timeSeries) []byte {
+	var ts, sample []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.Labels {
+			var lbl []byte
+			lbl = appendString(lbl, 1, l.Name)
+			lbl = appendString(lbl, 2, l.Value)
+			ts = appendBytes(ts, 1, lbl)
+		}
+
+		sample = appendTag(sample[:0], 1, wireFixed64)
+		sample = appendFixed64(sample, math.Float64bits(s.Value))
+		sample = appendTag(sample, 2, wireVarint)
+		sample = appendUvarint(sample, uint64(s.Timestamp))
+		ts = appendBytes(ts, 2, sample)
+
+		dst = appendBytes(dst, 1, ts)
+	}
+	return dst
+}
+
+func appendTag(dst []byte, field int, wire int) []byte {
+	return appendUvarint(dst, uint64(field<<3|wire))
+}
+
+func appendBytes(dst []byte, field int, b []byte) []byte {
+	dst = appendTag(dst, field, wireBytes)
+	dst = appendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+func appendString(dst []byte, field int, s string) []byte {
+	dst = appendTag(dst, field, wireBytes)
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendFixed64(dst []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(dst, b[:]...)
+}
@@ -0,0 +1,171 @@
+package remotewrite
+
+import (
+	"errors"
+	"github.com/golang/snappy"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/dogrelay/prometheus"
+	"github.com/mono83/dogrelay/transport"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config contains Prometheus remote write settings
+type Config struct {
+	URL            string            // Remote write endpoint, like http://mimir:9009/api/v1/push
+	ExternalLabels map[string]string // Labels, added to every series
+	BatchSize      int               // Max samples in single request
+	Timeout        time.Duration     // Single request timeout
+	MaxRetries     int               // Retries of failed request
+	Backoff        time.Duration     // Delay before first retry
+	TTL            time.Duration     // Counters, not updated during TTL, are reset, zero keeps them forever
+	BearerToken    string
+	Username       string
+	Password       string
+}
+
+// Writer sends flushed metrics to Prometheus remote write endpoint.
+// Counters are accumulated and sent as monotonic totals, all other
+// values are sent as they are. Idle counters are forgotten after TTL
+// and start from zero, which is read by receivers as counter reset.
+type Writer struct {
+	url       string
+	header    http.Header
+	external  []label
+	batchSize int
+	ttl       time.Duration
+	http      *transport.HTTP
+	log       xray.Ray
+
+	m        sync.Mutex
+	counters map[string]counter
+}
+
+type counter struct {
+	value   int64
+	updated time.Time
+}
+
+// NewWriter builds new remote write client
+func NewWriter(cfg Config) (*Writer, error) {
+	if len(cfg.URL) == 0 {
+		return nil, errors.New("empty remote write URL")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 2000
+	}
+
+	w := &Writer{
+		url:       cfg.URL,
+		header:    http.Header{},
+		batchSize: cfg.BatchSize,
+		ttl:       cfg.TTL,
+		http:      transport.NewHTTP(cfg.Timeout, cfg.MaxRetries, cfg.Backoff, false),
+		log:       xray.ROOT.Fork().WithLogger("remote-write").WithMetricPrefix("remotewrite"),
+		counters:  map[string]counter{},
+	}
+	w.header.Set("Content-Type", "application/x-protobuf")
+	w.header.Set("Content-Encoding", "snappy")
+	w.header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if len(cfg.BearerToken) > 0 {
+		w.header.Set("Authorization", "Bearer "+cfg.BearerToken)
+	} else if len(cfg.Username) > 0 {
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+		w.header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	for k, v := range cfg.ExternalLabels {
+		w.external = append(w.external, label{Name: prometheus.SanitizeLabel(k), Value: v})
+	}
+
+	return w, nil
+}
+
+// Write converts events, flushed at given time, into time series and
+// sends them in batches. Concurrent calls are serialized to keep
+// counters consistent. Order of samples relies on caller, fan-out
+// never runs writes of single sink concurrently.
+func (w *Writer) Write(ts time.Time, events []metrics.Event) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	millis := ts.UnixNano() / int64(time.Millisecond)
+	series := make([]timeSeries, 0, len(events))
+	for _, e := range events {
+		value := e.Value
+		if e.EventType == metrics.TypeIncrement {
+			key := e.Key()
+			value += w.counters[key].value
+			w.counters[key] = counter{value: value, updated: ts}
+		}
+		series = append(series, timeSeries{
+			Labels:    w.labels(e),
+			Value:     float64(value),
+			Timestamp: millis,
+		})
+	}
+	if w.ttl > 0 {
+		for key, c := range w.counters {
+			if ts.Sub(c.updated) > w.ttl {
+				delete(w.counters, key)
+			}
+		}
+	}
+
+	var first error
+	var body []byte
+	for len(series) > 0 {
+		batch := series
+		if len(batch) > w.batchSize {
+			batch = batch[:w.batchSize]
+		}
+		series = series[len(batch):]
+
+		body = marshalWriteRequest(body[:0], batch)
+		before := time.Now()
+		err := w.http.Post(w.url, w.header, snappy.Encode(nil, body))
+		w.log.Duration("latency", time.Now().Sub(before))
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			w.log.Error("Unable to send :count samples - :err", args.Count(len(batch)), args.Error{Err: err})
+			w.log.Inc("error")
+			continue
+		}
+		w.log.Inc("success")
+		w.log.Increment("samples", int64(len(batch)))
+	}
+
+	return first
+}
+
+// labels builds sorted labels of event, including metric name and
+// external labels. Event params take precedence over external labels.
+func (w *Writer) labels(e metrics.Event) []label {
+	labels := make([]label, 0, len(e.Params)+len(w.external)+1)
+	labels = append(labels, label{Name: "__name__", Value: prometheus.SanitizeName(e.Metric)})
+	seen := map[string]bool{"__name__": true}
+	for _, p := range e.Params {
+		if i := strings.IndexByte(p, '='); i > 0 && i < len(p)-1 {
+			name := prometheus.SanitizeLabel(p[:i])
+			if !seen[name] {
+				seen[name] = true
+				labels = append(labels, label{Name: name, Value: p[i+1:]})
+			}
+		}
+	}
+	for _, l := range w.external {
+		if !seen[l.Name] {
+			labels = append(labels, l)
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
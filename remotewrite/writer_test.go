@@ -0,0 +1,180 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/golang/snappy"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readField reads single protobuf field, returning field number,
+// wire type, varint or fixed value and bytes payload
+func readField(b []byte) (field, wire int, num uint64, payload, rest []byte, err error) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, 0, nil, nil, errors.New("invalid tag")
+	}
+	b = b[n:]
+	field, wire = int(tag>>3), int(tag&7)
+	switch wire {
+	case wireVarint:
+		num, n = binary.Uvarint(b)
+		if n <= 0 {
+			return 0, 0, 0, nil, nil, errors.New("invalid varint")
+		}
+		return field, wire, num, nil, b[n:], nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return 0, 0, 0, nil, nil, errors.New("invalid fixed64")
+		}
+		return field, wire, binary.LittleEndian.Uint64(b), nil, b[8:], nil
+	case wireBytes:
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return 0, 0, 0, nil, nil, errors.New("invalid length")
+		}
+		return field, wire, 0, b[n : n+int(l)], b[n+int(l):], nil
+	}
+	return 0, 0, 0, nil, nil, errors.New("unsupported wire type")
+}
+
+// decodeWriteRequest decodes WriteRequest message
+func decodeWriteRequest(b []byte) ([]timeSeries, error) {
+	var result []timeSeries
+	for len(b) > 0 {
+		_, _, _, tsBytes, rest, err := readField(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+
+		var ts timeSeries
+		for len(tsBytes) > 0 {
+			field, _, _, payload, rest, err := readField(tsBytes)
+			if err != nil {
+				return nil, err
+			}
+			tsBytes = rest
+			for len(payload) > 0 {
+				f, _, num, p, rest, err := readField(payload)
+				if err != nil {
+					return nil, err
+				}
+				payload = rest
+				switch {
+				case field == 1 && f == 1:
+					ts.Labels = append(ts.Labels, label{Name: string(p)})
+				case field == 1 && f == 2:
+					ts.Labels[len(ts.Labels)-1].Value = string(p)
+				case field == 2 && f == 1:
+					ts.Value = math.Float64frombits(num)
+				case field == 2 && f == 2:
+					ts.Timestamp = int64(num)
+				}
+			}
+		}
+		result = append(result, ts)
+	}
+	return result, nil
+}
+
+func TestWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var m sync.Mutex
+	var received []timeSeries
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		calls++
+		if calls == 1 {
+			// First attempt fails and must be retried
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		assert.Equal("snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal("application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal("Bearer secret", r.Header.Get("Authorization"))
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if assert.NoError(err) {
+			series, err := decodeWriteRequest(body)
+			if assert.NoError(err) {
+				received = append(received, series...)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w, err := NewWriter(Config{
+		URL:            server.URL,
+		ExternalLabels: map[string]string{"cluster": "eu", "host": "external"},
+		BatchSize:      1,
+		MaxRetries:     2,
+		BearerToken:    "secret",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	ts := time.Unix(100, 0)
+	events := []metrics.Event{
+		{EventType: metrics.TypeIncrement, Metric: "api.hits", Value: 3, Params: []string{"host=a"}},
+		{EventType: metrics.TypeGauge, Metric: "cpu", Value: 7},
+	}
+	assert.NoError(w.Write(ts, events))
+	assert.NoError(w.Write(ts.Add(time.Second), events[:1]))
+
+	if assert.Len(received, 3) {
+		assert.Equal(timeSeries{
+			Labels:    []label{{"__name__", "api_hits"}, {"cluster", "eu"}, {"host", "a"}},
+			Value:     3,
+			Timestamp: 100000,
+		}, received[0])
+		assert.Equal(timeSeries{
+			Labels:    []label{{"__name__", "cpu"}, {"cluster", "eu"}, {"host", "external"}},
+			Value:     7,
+			Timestamp: 100000,
+		}, received[1])
+		// Counters are cumulative
+		assert.Equal(float64(6), received[2].Value)
+		assert.Equal(int64(101000), received[2].Timestamp)
+	}
+}
+
+func TestWriterTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w, err := NewWriter(Config{URL: server.URL, TTL: time.Minute})
+	if !assert.NoError(err) {
+		return
+	}
+
+	ts := time.Unix(100, 0)
+	hits := []metrics.Event{{EventType: metrics.TypeIncrement, Metric: "api.hits", Value: 3}}
+	misses := []metrics.Event{{EventType: metrics.TypeIncrement, Metric: "api.misses", Value: 1}}
+	assert.NoError(w.Write(ts, hits))
+	assert.NoError(w.Write(ts.Add(time.Minute), misses))
+	assert.Len(w.counters, 2)
+
+	// Idle counter is forgotten
+	assert.NoError(w.Write(ts.Add(2*time.Minute), misses))
+	assert.Len(w.counters, 1)
+	assert.Equal(int64(2), w.counters[misses[0].Key()].value)
+}
@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"errors"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is reported when sink does not complete write in time
+var ErrTimeout = errors.New("sink write timed out")
+
+// ErrBusy is reported when flush is skipped, because previous timed out
+// write of sink is still running
+var ErrBusy = errors.New("sink is busy with previous write")
+
+// Sink receives metrics, flushed at given time. Fan-out never invokes
+// Write of single sink concurrently.
+type Sink interface {
+	Write(ts time.Time, events []metrics.Event) error
+}
+
+// Func is adapter, allowing use of ordinary function as Sink
+type Func func(ts time.Time, events []metrics.Event) error
+
+// Write is Sink interface implementation
+func (f Func) Write(ts time.Time, events []metrics.Event) error {
+	return f(ts, events)
+}
+
+// Defaults for per sink queues
+const (
+	DefaultQueueSize = 10
+	DefaultTimeout   = 30 * time.Second
+)
+
+// FanOut delivers every flush to many sinks. Each sink has own queue and
+// worker goroutine, so slow or failing sink does not stall others. When
+// queue is full, oldest flush is dropped.
+type FanOut struct {
+	log     xray.Ray
+	outputs []*output
+	wg      sync.WaitGroup
+}
+
+type output struct {
+	name    string
+	sink    Sink
+	timeout time.Duration
+	queue   chan flush
+	log     xray.Ray
+	pending chan error // Result of timed out write, still running
+	writes  sync.WaitGroup
+}
+
+type flush struct {
+	ts     time.Time
+	events []metrics.Event
+}
+
+// NewFanOut builds new empty fan-out
+func NewFanOut() *FanOut {
+	return &FanOut{log: xray.ROOT.Fork().WithLogger("sink").WithMetricPrefix("sink")}
+}
+
+// Add registers sink under given name and starts its worker. Queue size
+// is amount of flushes, waiting for delivery, zero means DefaultQueueSize.
+// Zero timeout means DefaultTimeout.
+func (f *FanOut) Add(name string, s Sink, queueSize int, timeout time.Duration) {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	o := &output{
+		name:    name,
+		sink:    s,
+		timeout: timeout,
+		queue:   make(chan flush, queueSize),
+		log:     f.log.With(args.Name(name)),
+	}
+	f.outputs = append(f.outputs, o)
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		o.run()
+		o.writes.Wait()
+	}()
+}
+
+// Len returns amount of registered sinks
+func (f *FanOut) Len() int {
+	return len(f.outputs)
+}
+
+// Write places events, flushed at given time, into queues of all sinks.
+// It never blocks, events slice must not be modified afterwards.
+func (f *FanOut) Write(ts time.Time, events []metrics.Event) error {
+	for _, o := range f.outputs {
+		o.enqueue(flush{ts: ts, events: events})
+	}
+	return nil
+}
+
+// Close stops accepting flushes and waits until queued ones are delivered
+// and timed out writes, still running, complete. Sinks may be closed after
+// it returns.
+func (f *FanOut) Close() error {
+	for _, o := range f.outputs {
+		close(o.queue)
+	}
+	f.wg.Wait()
+	return nil
+}
+
+func (o *output) enqueue(fl flush) {
+	for {
+		select {
+		case o.queue <- fl:
+			o.log.Gauge("queue", int64(len(o.queue)))
+			return
+		default:
+		}
+
+		// Queue is full, dropping oldest flush
+		select {
+		case old := <-o.queue:
+			o.log.Increment("dropped", int64(len(old.events)))
+			o.log.Warning("Queue of :name is full, dropped :count events", args.Count(len(old.events)))
+		default:
+		}
+	}
+}
+
+func (o *output) run() {
+	for fl := range o.queue {
+		before := time.Now()
+		err := o.write(fl)
+		o.log.Duration("latency", time.Now().Sub(before))
+		if err != nil {
+			typ := "sink"
+			if err == ErrTimeout {
+				typ = "timeout"
+			} else if err == ErrBusy {
+				typ = "busy"
+			}
+			o.log.Inc("error", args.Type(typ))
+			o.log.Error("Error writing :count events to :name - :err", args.Count(len(fl.events)), args.Error{Err: err})
+			continue
+		}
+		o.log.Increment("written", int64(len(fl.events)))
+	}
+}
+
+// write invokes sink, giving up waiting after timeout. Flush is skipped
+// while timed out write is still running, so every sink has at most one
+// goroutine at a time.
+func (o *output) write(fl flush) error {
+	if o.pending != nil {
+		select {
+		case <-o.pending:
+			o.pending = nil
+		default:
+			return ErrBusy
+		}
+	}
+
+	done := make(chan error, 1)
+	o.writes.Add(1)
+	go func() {
+		defer o.writes.Done()
+		done <- o.sink.Write(fl.ts, fl.events)
+	}()
+
+	timer := time.NewTimer(o.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		o.pending = done
+		return ErrTimeout
+	}
+}
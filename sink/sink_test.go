@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"errors"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	m     sync.Mutex
+	times []int64
+	block chan struct{}
+	err   error
+}
+
+func (r *recorder) Write(ts time.Time, events []metrics.Event) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.times = append(r.times, ts.Unix())
+	return r.err
+}
+
+func (r *recorder) received() []int64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]int64(nil), r.times...)
+}
+
+func TestFanOutIsolation(t *testing.T) {
+	assert := assert.New(t)
+
+	fast := &recorder{}
+	failing := &recorder{err: errors.New("failure")}
+	slow := &recorder{block: make(chan struct{})}
+
+	f := NewFanOut()
+	f.Add("fast", fast, 0, 0)
+	f.Add("failing", failing, 0, 0)
+	f.Add("slow", slow, 2, time.Hour)
+	assert.Equal(3, f.Len())
+
+	for i := int64(1); i <= 5; i++ {
+		assert.NoError(f.Write(time.Unix(i, 0), nil))
+		// Letting slow worker pick first flush
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Slow sink does not stall others
+	deadline := time.Now().Add(time.Second)
+	for len(fast.received()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal([]int64{1, 2, 3, 4, 5}, fast.received())
+
+	// Slow sink got first flush and two latest, others were dropped
+	close(slow.block)
+	assert.NoError(f.Close())
+	assert.Equal([]int64{1, 2, 3, 4, 5}, failing.received())
+	assert.Equal([]int64{1, 4, 5}, slow.received())
+}
+
+func TestFanOutTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	defer close(block)
+	o := &output{sink: &recorder{block: block}, timeout: 10 * time.Millisecond}
+	assert.Equal(ErrTimeout, o.write(flush{}))
+
+	o = &output{sink: Func(func(time.Time, []metrics.Event) error { return nil }), timeout: time.Second}
+	assert.NoError(o.write(flush{}))
+}
+
+func TestFanOutBusy(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	r := &recorder{block: block}
+	o := &output{sink: r, timeout: time.Millisecond}
+	before := runtime.NumGoroutine()
+	assert.Equal(ErrTimeout, o.write(flush{ts: time.Unix(1, 0)}))
+	for i := 0; i < 100; i++ {
+		assert.Equal(ErrBusy, o.write(flush{ts: time.Unix(2, 0)}))
+	}
+	assert.True(runtime.NumGoroutine() <= before+1)
+
+	// Sink is used again after blocked write completes
+	close(block)
+	err := o.write(flush{ts: time.Unix(3, 0)})
+	for err == ErrBusy {
+		time.Sleep(time.Millisecond)
+		err = o.write(flush{ts: time.Unix(3, 0)})
+	}
+	assert.NoError(err)
+	assert.Equal([]int64{1, 3}, r.received())
+}
+
+func TestFanOutCloseWaitsTimedOut(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	r := &recorder{block: block}
+	f := NewFanOut()
+	f.Add("slow", r, 0, time.Millisecond)
+	assert.NoError(f.Write(time.Unix(1, 0), nil))
+
+	closed := make(chan struct{})
+	go func() {
+		_ = f.Close()
+		close(closed)
+	}()
+
+	// Write timed out, but Close waits for it
+	select {
+	case <-closed:
+		t.Fatal("Close returned while write is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(block)
+	<-closed
+	assert.Equal([]int64{1}, r.received())
+}
@@ -0,0 +1,223 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// List of spool errors
+var (
+	ErrFull      = errors.New("spool size limit reached")
+	ErrEmpty     = errors.New("spool is empty")
+	ErrCorrupted = errors.New("spool segment is corrupted")
+)
+
+const (
+	segmentExt = ".seg"
+	headerSize = 8 // Record length and CRC32 checksum
+)
+
+// Spool is disk backed queue of records. Records are appended to active
+// segment file, which is sealed when it grows over segment size, and read
+// by whole segments, oldest first. Every record is prefixed with its
+// length and CRC32 checksum, so torn writes and corruption are detected.
+// Segments survive restarts, after reopening new active segment is started.
+type Spool struct {
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+
+	m          sync.Mutex
+	sealed     []int64 // Sequence numbers of sealed segments, oldest first
+	sizes      map[int64]int64
+	size       int64
+	active     *os.File
+	activeSeq  int64
+	activeSize int64
+}
+
+// Open opens spool in given directory, creating it if needed. Total size
+// of segments is limited by max bytes, zero means no limit.
+func Open(dir string, maxBytes, segmentSize int64) (*Spool, error) {
+	if segmentSize <= 0 {
+		segmentSize = 16 << 20
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes, segmentSize: segmentSize, sizes: map[int64]int64{}}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if f.Size() == 0 {
+			_ = os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		s.sealed = append(s.sealed, seq)
+		s.sizes[seq] = f.Size()
+		s.size += f.Size()
+		if seq > s.activeSeq {
+			s.activeSeq = seq
+		}
+	}
+	sort.Slice(s.sealed, func(i, j int) bool { return s.sealed[i] < s.sealed[j] })
+	return s, nil
+}
+
+func (s *Spool) path(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// Size returns total size of spooled data in bytes
+func (s *Spool) Size() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.size
+}
+
+// Append writes records to active segment and syncs it to disk. Either
+// all records are written or none, ErrFull is returned when they do not
+// fit into size limit.
+func (s *Spool) Append(records ...[]byte) error {
+	var buf []byte
+	for _, r := range records {
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(r)))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(r))
+		buf = append(buf, header[:]...)
+		buf = append(buf, r...)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.maxBytes > 0 && s.size+int64(len(buf)) > s.maxBytes {
+		return ErrFull
+	}
+	if s.active == nil {
+		s.activeSeq++
+		f, err := os.OpenFile(s.path(s.activeSeq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		s.active = f
+		s.activeSize = 0
+	}
+
+	n, err := s.active.Write(buf)
+	s.activeSize += int64(n)
+	s.size += int64(n)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil || s.activeSize >= s.segmentSize {
+		// Failed segment is sealed too, so partial write is detected
+		// by checksum on read
+		if serr := s.seal(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// seal closes active segment and makes it available for reading,
+// must be invoked under lock
+func (s *Spool) seal() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	s.sealed = append(s.sealed, s.activeSeq)
+	s.sizes[s.activeSeq] = s.activeSize
+	return err
+}
+
+// Read returns id and records of oldest segment, sealing active one if
+// there are no other. ErrEmpty is returned for empty spool. If segment is
+// corrupted, valid records before corruption are returned with
+// ErrCorrupted. Segment stays in spool until removed.
+func (s *Spool) Read() (int64, [][]byte, error) {
+	s.m.Lock()
+	if len(s.sealed) == 0 {
+		if err := s.seal(); err != nil {
+			s.m.Unlock()
+			return 0, nil, err
+		}
+	}
+	if len(s.sealed) == 0 {
+		s.m.Unlock()
+		return 0, nil, ErrEmpty
+	}
+	seq := s.sealed[0]
+	s.m.Unlock()
+
+	data, err := ioutil.ReadFile(s.path(seq))
+	if err != nil {
+		return seq, nil, err
+	}
+	var records [][]byte
+	for len(data) > 0 {
+		if len(data) < headerSize {
+			return seq, records, ErrCorrupted
+		}
+		length := binary.BigEndian.Uint32(data[:4])
+		checksum := binary.BigEndian.Uint32(data[4:headerSize])
+		data = data[headerSize:]
+		if uint64(len(data)) < uint64(length) || crc32.ChecksumIEEE(data[:length]) != checksum {
+			return seq, records, ErrCorrupted
+		}
+		records = append(records, data[:length])
+		data = data[length:]
+	}
+	return seq, records, nil
+}
+
+// Remove deletes segment with given id
+func (s *Spool) Remove(id int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i, seq := range s.sealed {
+		if seq == id {
+			s.sealed = append(s.sealed[:i], s.sealed[i+1:]...)
+			s.size -= s.sizes[seq]
+			delete(s.sizes, seq)
+			if err := os.Remove(s.path(seq)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Close closes active segment
+func (s *Spool) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	return s.seal()
+}
@@ -0,0 +1,98 @@
+package spool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, 60, 20)
+	if !assert.NoError(err) {
+		return
+	}
+	_, _, err = s.Read()
+	assert.Equal(ErrEmpty, err)
+
+	// Segments are sealed when they grow over 20 bytes
+	assert.NoError(s.Append([]byte("one"), []byte("two")))
+	assert.NoError(s.Append([]byte("three")))
+	assert.NoError(s.Append([]byte("four")))
+	assert.Equal(int64(11+11+13+12), s.Size())
+
+	// Size limit
+	assert.Equal(ErrFull, s.Append([]byte("too long record")))
+
+	id, records, err := s.Read()
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("one"), []byte("two")}, records)
+	assert.NoError(s.Remove(id))
+	assert.Equal(int64(25), s.Size())
+	assert.NoError(s.Close())
+
+	// Reopened spool keeps remaining segment and appends to new one
+	s, err = Open(dir, 60, 20)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(int64(25), s.Size())
+	assert.NoError(s.Append([]byte("five")))
+	id, records, err = s.Read()
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("three"), []byte("four")}, records)
+	assert.NoError(s.Remove(id))
+	id, records, err = s.Read()
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("five")}, records)
+	assert.NoError(s.Remove(id))
+	_, _, err = s.Read()
+	assert.Equal(ErrEmpty, err)
+	assert.NoError(s.Close())
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(files, 0)
+}
+
+func TestSpoolCorrupted(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, 0, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Append([]byte("first"), []byte("second"), []byte("third")))
+	assert.NoError(s.Close())
+
+	// Flip byte inside second record
+	name := filepath.Join(dir, "00000000000000000001.seg")
+	bts, err := ioutil.ReadFile(name)
+	if !assert.NoError(err) {
+		return
+	}
+	bts[13+8+2] ^= 0xff
+	assert.NoError(ioutil.WriteFile(name, bts, 0644))
+
+	s, err = Open(dir, 0, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	_, records, err := s.Read()
+	assert.Equal(ErrCorrupted, err)
+	assert.Equal([][]byte{[]byte("first")}, records)
+}
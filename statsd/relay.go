@@ -0,0 +1,329 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/udpwriter"
+	"github.com/mono83/xray"
+	"github.com/mono83/xray/args"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPayloadSize is default max size of datagram, sent upstream
+const DefaultPayloadSize = 1400
+
+// Config contains relay settings
+type Config struct {
+	Upstreams     []string      // Addresses of upstream StatsD servers
+	Replicas      int           // Virtual nodes of every upstream on hash ring
+	PayloadSize   int           // Max size of single datagram
+	FlushInterval time.Duration // Max delay of raw events in partially filled datagram
+	CheckInterval time.Duration // Interval of upstream health checks, zero disables them
+	CheckTimeout  time.Duration // Time to wait for health check failure
+
+	// Checker checks upstream health, returning error for failed one.
+	// Nil means UDPCheck.
+	Checker func(addr string, timeout time.Duration) error
+}
+
+// Relay forwards metrics to upstream StatsD servers in DogStatsD format.
+// Upstream is chosen by consistent hashing of metric key, so same series
+// always lands on same upstream while it is healthy.
+type Relay struct {
+	cfg       Config
+	log       xray.Ray
+	upstreams map[string]*outbox
+	ring      atomic.Value // *Ring, replaced on health change
+	stop      chan struct{}
+	done      sync.WaitGroup
+
+	check   sync.Mutex
+	healthy map[string]bool
+}
+
+// outbox holds datagram, being filled for single upstream. Every
+// upstream has own lock, so raw events for different upstreams are
+// packed concurrently.
+type outbox struct {
+	addr string
+	w    io.Writer
+
+	m    sync.Mutex
+	buf  []byte
+	line []byte
+}
+
+// NewRelay builds new relay and starts health checks and periodic flush
+// of raw events
+func NewRelay(cfg Config) (*Relay, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, errors.New("no StatsD upstreams provided")
+	}
+	if cfg.PayloadSize <= 0 {
+		cfg.PayloadSize = DefaultPayloadSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.CheckTimeout <= 0 {
+		cfg.CheckTimeout = time.Second
+	}
+	if cfg.Checker == nil {
+		cfg.Checker = UDPCheck
+	}
+
+	r := &Relay{
+		cfg:       cfg,
+		log:       xray.ROOT.Fork().WithLogger("statsd-relay").WithMetricPrefix("relay"),
+		upstreams: map[string]*outbox{},
+		stop:      make(chan struct{}),
+		healthy:   map[string]bool{},
+	}
+	for _, addr := range cfg.Upstreams {
+		w, err := udpwriter.NewS(addr)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams[addr] = &outbox{addr: addr, w: w}
+		r.healthy[addr] = true
+	}
+	r.ring.Store(NewRing(cfg.Upstreams, cfg.Replicas))
+
+	r.every(cfg.FlushInterval, r.flush)
+	if cfg.CheckInterval > 0 {
+		r.every(cfg.CheckInterval, r.Check)
+	}
+	return r, nil
+}
+
+// every runs given function periodically until relay is closed
+func (r *Relay) every(interval time.Duration, fn func()) {
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// Close stops periodic flush and health checks and sends partially
+// filled datagrams
+func (r *Relay) Close() error {
+	close(r.stop)
+	r.done.Wait()
+	r.flush()
+	return nil
+}
+
+// Write forwards events, flushed at given time. Counters and gauges keep
+// their types. Timer count and sum are sent as counters, so upstream
+// adds them up, other timer statistics are sent as gauges, because
+// they are already aggregated.
+func (r *Relay) Write(ts time.Time, events []metrics.Event) error {
+	var key []byte
+	for _, e := range events {
+		typ := "g"
+		if e.EventType == metrics.TypeIncrement ||
+			(e.EventType == metrics.TypeDuration && (e.Field == "count" || e.Field == "sum")) {
+			typ = "c"
+		}
+		key = e.AppendKey(key[:0])
+		r.route(key, e.Value, typ)
+	}
+	r.flush()
+	return nil
+}
+
+// Add forwards raw event, given as key in metrics.Event.AppendKey format
+// and value. Raw events are packed into datagrams, which are sent when
+// full or after flush interval. Signature matches udp.StartMetricsServer
+// callback.
+func (r *Relay) Add(key []byte, value int64) {
+	if len(key) < 2 {
+		return
+	}
+	var typ string
+	switch key[0] {
+	case metrics.TypeIncrement:
+		typ = "c"
+	case metrics.TypeGauge:
+		typ = "g"
+	case metrics.TypeDuration:
+		typ = "ms"
+	default:
+		return
+	}
+
+	r.route(key, value, typ)
+}
+
+// route appends DogStatsD line to buffer of upstream, responsible for key
+func (r *Relay) route(key []byte, value int64, typ string) {
+	u := r.upstreams[r.ring.Load().(*Ring).Get(key)]
+
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.line = AppendLine(u.line[:0], key, value, typ)
+	if len(u.buf) > 0 && len(u.buf)+1+len(u.line) > r.cfg.PayloadSize {
+		r.send(u)
+	}
+	if len(u.buf) > 0 {
+		u.buf = append(u.buf, '\n')
+	}
+	u.buf = append(u.buf, u.line...)
+}
+
+// flush sends all partially filled datagrams
+func (r *Relay) flush() {
+	for _, u := range r.upstreams {
+		u.m.Lock()
+		if len(u.buf) > 0 {
+			r.send(u)
+		}
+		u.m.Unlock()
+	}
+}
+
+// send writes datagram of upstream and resets it, must be called under
+// upstream lock
+func (r *Relay) send(u *outbox) {
+	n := len(u.buf)
+	_, err := u.w.Write(u.buf)
+	u.buf = u.buf[:0]
+	if err != nil {
+		r.log.Inc("error", args.Addr(u.addr))
+		return
+	}
+	r.log.Inc("datagrams", args.Addr(u.addr))
+	r.log.Increment("size", int64(n), args.Addr(u.addr))
+}
+
+// Check checks health of all upstreams and rebuilds hash ring if it
+// changed. When all upstreams fail, ring includes all of them.
+func (r *Relay) Check() {
+	healthy := map[string]bool{}
+	for _, addr := range r.cfg.Upstreams {
+		err := r.cfg.Checker(addr, r.cfg.CheckTimeout)
+		if err != nil {
+			r.log.Inc("check.fail", args.Addr(addr))
+		}
+		healthy[addr] = err == nil
+	}
+
+	r.check.Lock()
+	defer r.check.Unlock()
+	changed := false
+	var nodes []string
+	for _, addr := range r.cfg.Upstreams {
+		if healthy[addr] != r.healthy[addr] {
+			changed = true
+			if healthy[addr] {
+				r.log.Info("Upstream :addr is back", args.Addr(addr))
+			} else {
+				r.log.Warning("Upstream :addr failed health check", args.Addr(addr))
+			}
+		}
+		if healthy[addr] {
+			nodes = append(nodes, addr)
+		}
+	}
+	if !changed {
+		return
+	}
+	if len(nodes) == 0 {
+		r.log.Error("All upstreams failed health check")
+		nodes = r.cfg.Upstreams
+	}
+
+	// Pending data was routed using previous ring and is delivered to
+	// upstreams it was packed for
+	r.healthy = healthy
+	r.ring.Store(NewRing(nodes, r.cfg.Replicas))
+	r.flush()
+	r.log.Inc("ring.rebuild")
+	r.log.Info("Hash ring rebuilt with :count upstreams", args.Count(len(nodes)))
+}
+
+// UDPCheck sends empty datagram to given address and waits for ICMP
+// port unreachable, reported as read error on connected socket.
+// StatsD never answers over UDP, so silence until timeout is the only
+// outcome of live upstream and is treated as healthy. This only detects
+// closed ports on reachable hosts: host, that is down or firewalled,
+// drops datagrams silently and still passes. Use Config.Checker with
+// stronger check, like TCP admin port probe, when that matters.
+func UDPCheck(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// AppendLine appends DogStatsD line for metric, given as key in
+// metrics.Event.AppendKey format, like name:value|type|#tag:value
+func AppendLine(dst, key []byte, value int64, typ string) []byte {
+	if len(key) < 2 {
+		return dst
+	}
+
+	metric, rest := nextChunk(key[2:])
+	dst = append(dst, metric...)
+	dst = append(dst, ':')
+	dst = strconv.AppendInt(dst, value, 10)
+	dst = append(dst, '|')
+	dst = append(dst, typ...)
+
+	tags := 0
+	for len(rest) > 0 {
+		var tag []byte
+		tag, rest = nextChunk(rest)
+		if len(tag) == 0 {
+			continue
+		}
+		if tags == 0 {
+			dst = append(dst, "|#"...)
+		} else {
+			dst = append(dst, ',')
+		}
+		tags++
+		if i := bytes.IndexByte(tag, '='); i >= 0 {
+			dst = append(dst, tag[:i]...)
+			dst = append(dst, ':')
+			tag = tag[i+1:]
+		}
+		dst = append(dst, tag...)
+	}
+	return dst
+}
+
+// nextChunk splits key by first tab
+func nextChunk(b []byte) (chunk, rest []byte) {
+	if i := bytes.IndexByte(b, '\t'); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
@@ -0,0 +1,214 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes := []string{"a:8125", "b:8125", "c:8125"}
+	full := NewRing(nodes, 0)
+	reduced := NewRing([]string{"a:8125", "c:8125"}, 0)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("i\tmetric.%d\t", i))
+		node := full.Get(key)
+		counts[node]++
+
+		// Only keys of removed node are moved
+		if node != "b:8125" {
+			assert.Equal(node, reduced.Get(key))
+		} else {
+			assert.NotEqual(node, reduced.Get(key))
+		}
+	}
+	for _, node := range nodes {
+		assert.InDelta(1000, counts[node], 300, node)
+	}
+
+	// Order of nodes does not matter
+	shuffled := NewRing([]string{"c:8125", "a:8125", "b:8125"}, 0)
+	assert.Equal(full.Get([]byte("i\tfoo\t")), shuffled.Get([]byte("i\tfoo\t")))
+	assert.Equal("", NewRing(nil, 0).Get([]byte("foo")))
+}
+
+func TestAppendLine(t *testing.T) {
+	assert := assert.New(t)
+
+	e := metrics.Event{EventType: metrics.TypeIncrement, Metric: "api.hits", Params: []string{"env=live", "canary"}}
+	assert.Equal("api.hits:5|c|#env:live,canary", string(AppendLine(nil, e.AppendKey(nil), 5, "c")))
+
+	e = metrics.Event{EventType: metrics.TypeDuration, Metric: "api.time"}
+	assert.Equal("api.time:-3|ms", string(AppendLine(nil, e.AppendKey(nil), -3, "ms")))
+}
+
+type upstream struct {
+	conn  *net.UDPConn
+	m     sync.Mutex
+	lines []string
+}
+
+func listen(t *testing.T) *upstream {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &upstream{conn: conn}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			u.m.Lock()
+			u.lines = append(u.lines, strings.Split(string(buf[:n]), "\n")...)
+			u.m.Unlock()
+		}
+	}()
+	return u
+}
+
+func (u *upstream) received() []string {
+	u.m.Lock()
+	defer u.m.Unlock()
+	return append([]string(nil), u.lines...)
+}
+
+func waitLines(us []*upstream, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var all []string
+		for _, u := range us {
+			all = append(all, u.received()...)
+		}
+		if len(all) >= count || time.Now().After(deadline) {
+			return all
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := listen(t), listen(t)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	var failed sync.Map
+	r, err := NewRelay(Config{
+		Upstreams: []string{a.conn.LocalAddr().String(), b.conn.LocalAddr().String()},
+		Checker: func(addr string, _ time.Duration) error {
+			if _, ok := failed.Load(addr); ok {
+				return errors.New("down")
+			}
+			return nil
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	var events []metrics.Event
+	for i := 0; i < 50; i++ {
+		events = append(events, metrics.Event{EventType: metrics.TypeIncrement, Metric: fmt.Sprintf("m%d", i), Value: 1})
+	}
+	assert.NoError(r.Write(time.Now(), events))
+	all := waitLines([]*upstream{a, b}, 50)
+	assert.Len(all, 50)
+	assert.NotEmpty(a.received())
+	assert.NotEmpty(b.received())
+
+	// Node b fails, all series move to a
+	before := len(a.received())
+	failed.Store(b.conn.LocalAddr().String(), true)
+	r.Check()
+	assert.NoError(r.Write(time.Now(), events))
+	assert.Len(waitLines([]*upstream{a}, before+50), before+50)
+
+	// Raw events are flushed periodically
+	r.Add(metrics.Event{EventType: metrics.TypeDuration, Metric: "raw"}.AppendKey(nil), 12)
+	assert.Contains(waitLines([]*upstream{a}, before+51), "raw:12|ms")
+}
+
+func TestRelayTimer(t *testing.T) {
+	assert := assert.New(t)
+
+	a := listen(t)
+	defer a.conn.Close()
+
+	r, err := NewRelay(Config{Upstreams: []string{a.conn.LocalAddr().String()}})
+	if !assert.NoError(err) {
+		return
+	}
+
+	timer := metrics.Event{EventType: metrics.TypeDuration, Metric: "db"}
+	gauge := metrics.Event{EventType: metrics.TypeGauge, Metric: "cpu"}
+	assert.NoError(r.Write(time.Now(), []metrics.Event{
+		timer.WithField(3, "", "count"),
+		timer.WithField(30, "", "sum"),
+		timer.WithField(10, "", "avg"),
+		gauge.WithField(5, "", "sum"),
+	}))
+	lines := waitLines([]*upstream{a}, 4)
+	assert.Contains(lines, "db.count:3|c")
+	assert.Contains(lines, "db.sum:30|c")
+	assert.Contains(lines, "db.avg:10|g")
+	assert.Contains(lines, "cpu.sum:5|g")
+}
+
+func TestRelayClose(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := listen(t), listen(t)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	r, err := NewRelay(Config{
+		Upstreams:     []string{a.conn.LocalAddr().String(), b.conn.LocalAddr().String()},
+		FlushInterval: time.Hour,
+		CheckInterval: time.Millisecond,
+		Checker:       func(string, time.Duration) error { return nil },
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Raw events are packed concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				r.Add(metrics.Event{EventType: metrics.TypeIncrement, Metric: fmt.Sprintf("m%d.%d", i, j)}.AppendKey(nil), 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Partially filled datagrams are sent on close
+	assert.NoError(r.Close())
+	assert.Len(waitLines([]*upstream{a, b}, 100), 100)
+}
+
+func TestUDPCheck(t *testing.T) {
+	u := listen(t)
+	addr := u.conn.LocalAddr().String()
+	assert.NoError(t, UDPCheck(addr, 100*time.Millisecond))
+
+	// Closed port is reported with ICMP port unreachable
+	u.conn.Close()
+	assert.Error(t, UDPCheck(addr, 100*time.Millisecond))
+}
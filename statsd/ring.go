@@ -0,0 +1,76 @@
+package statsd
+
+import "sort"
+
+// DefaultReplicas is default amount of virtual nodes of every upstream
+// on hash ring
+const DefaultReplicas = 128
+
+// Ring is consistent hash ring. Every node is placed on ring many times,
+// so keys are spread evenly and only keys of removed node move to other
+// nodes on rebuild. Ring is immutable and safe for concurrent use.
+type Ring struct {
+	points []uint32
+	nodes  []string
+}
+
+// NewRing builds hash ring over given nodes
+func NewRing(nodes []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Ring{
+		points: make([]uint32, 0, len(nodes)*replicas),
+		nodes:  make([]string, 0, len(nodes)*replicas),
+	}
+	owners := map[uint32]string{}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			point := hash(append([]byte(node), '#', byte(i), byte(i>>8)))
+			if prev, ok := owners[point]; ok && prev < node {
+				// Collision, resolved same way regardless of nodes order
+				continue
+			}
+			owners[point] = node
+		}
+	}
+	for point := range owners {
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	for _, point := range r.points {
+		r.nodes = append(r.nodes, owners[point])
+	}
+	return r
+}
+
+// Get returns node, responsible for given key. Returns empty string
+// for empty ring.
+func (r *Ring) Get(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[i]
+}
+
+// hash is FNV-1a with final avalanche, because plain FNV places similar
+// virtual node names close to each other
+func hash(b []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
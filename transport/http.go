@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const userAgent = "dogrelay"
+
+// StatusError is returned when server responds with non 2xx status code
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e StatusError) Error() string {
+	if len(e.Body) > 0 {
+		return fmt.Sprintf("http status %d - %s", e.Code, e.Body)
+	}
+	return fmt.Sprintf("http status %d", e.Code)
+}
+
+// Temporary returns true if request may succeed when retried.
+// Server errors, throttling and timeouts are temporary, other client
+// errors are not.
+func (e StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests || e.Code == http.StatusRequestTimeout
+}
+
+// IsTemporary returns true if given error, returned by HTTP.Post, may
+// disappear on retry
+func IsTemporary(err error) bool {
+	if se, ok := err.(StatusError); ok {
+		return se.Temporary()
+	}
+	return err != nil
+}
+
+// ErrorType returns short error kind for metrics - client for rejected
+// requests, server for temporary statuses and io for network errors
+func ErrorType(err error) string {
+	if se, ok := err.(StatusError); ok {
+		if se.Temporary() {
+			return "server"
+		}
+		return "client"
+	}
+	return "io"
+}
+
+// HTTP is HTTP client, that posts payloads with bounded amount of
+// retries and exponential backoff between them
+type HTTP struct {
+	Client     *http.Client
+	MaxRetries int           // Amount of retries after first attempt
+	Backoff    time.Duration // Delay before first retry, doubled on every next one
+	MaxBackoff time.Duration // Upper limit for delay between retries
+	Gzip       bool          // Compress request bodies
+}
+
+// NewHTTP builds HTTP client with given timeout and retries
+func NewHTTP(timeout time.Duration, maxRetries int, backoff time.Duration, gzip bool) *HTTP {
+	return &HTTP{
+		Client:     &http.Client{Timeout: timeout},
+		MaxRetries: maxRetries,
+		Backoff:    backoff,
+		MaxBackoff: 30 * time.Second,
+		Gzip:       gzip,
+	}
+}
+
+// Post sends given body to URL. Network errors and temporary statuses
+// are retried, other non 2xx responses are returned as StatusError
+// immediately.
+func (h *HTTP) Post(url string, header http.Header, body []byte) error {
+	if h.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write(body)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	var err error
+	for attempt := 0; attempt <= h.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(h.delay(attempt))
+		}
+		if err = h.post(url, header, body); !IsTemporary(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// delay returns backoff before given attempt with jitter up to 25%
+func (h *HTTP) delay(attempt int) time.Duration {
+	return Backoff(attempt, h.Backoff, h.MaxBackoff)
+}
+
+// Backoff returns delay before given retry attempt, starting from one.
+// Base delay is doubled on every attempt up to max, zero max means no
+// limit. Random jitter up to 25% is added, so clients, failed at same
+// time, do not retry simultaneously.
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && (max <= 0 || d < max); i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	if d > 0 {
+		d += time.Duration(rand.Int63n(int64(d)/4 + 1))
+	}
+	return d
+}
+
+func (h *HTTP) post(url string, header http.Header, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if h.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return StatusError{Code: res.StatusCode, Body: string(bytes.TrimSpace(msg))}
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
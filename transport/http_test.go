@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusClassification(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		err       error
+		temporary bool
+		typ       string
+	}{
+		{StatusError{Code: 400}, false, "client"},
+		{StatusError{Code: 401}, false, "client"},
+		{StatusError{Code: 404}, false, "client"},
+		{StatusError{Code: 413}, false, "client"},
+		{StatusError{Code: 408}, true, "server"},
+		{StatusError{Code: 429}, true, "server"},
+		{StatusError{Code: 500}, true, "server"},
+		{StatusError{Code: 503}, true, "server"},
+		{errors.New("connection refused"), true, "io"},
+	} {
+		assert.Equal(c.temporary, IsTemporary(c.err), c.err.Error())
+		assert.Equal(c.typ, ErrorType(c.err), c.err.Error())
+	}
+	assert.False(IsTemporary(nil))
+
+	assert.Equal("http status 400", StatusError{Code: 400}.Error())
+	assert.Equal("http status 400 - bad line", StatusError{Code: 400, Body: "bad line"}.Error())
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		attempt   int
+		base, max time.Duration
+		expected  time.Duration // Before jitter
+	}{
+		{1, 100 * time.Millisecond, time.Second, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, time.Second, 200 * time.Millisecond},
+		{4, 100 * time.Millisecond, time.Second, 800 * time.Millisecond},
+		{5, 100 * time.Millisecond, time.Second, time.Second},
+		{100, 100 * time.Millisecond, time.Second, time.Second},
+		{5, 100 * time.Millisecond, 0, 1600 * time.Millisecond},
+		{3, 0, time.Second, 0},
+	} {
+		for i := 0; i < 100; i++ {
+			d := Backoff(c.attempt, c.base, c.max)
+			assert.True(d >= c.expected && d <= c.expected+c.expected/4, "attempt %d: %s", c.attempt, d)
+		}
+	}
+}
+
+func TestHTTPPost(t *testing.T) {
+	assert := assert.New(t)
+
+	var m sync.Mutex
+	var statuses []int
+	var received []string
+	var encoding, agent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		encoding, agent = r.Header.Get("Content-Encoding"), r.Header.Get("User-Agent")
+		body := r.Body
+		if encoding == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if !assert.NoError(err) {
+				return
+			}
+			body = gz
+		}
+		bts, _ := ioutil.ReadAll(body)
+		received = append(received, string(bts))
+
+		status := http.StatusNoContent
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+		if status >= 300 {
+			_, _ = w.Write([]byte(" rejected \n"))
+		}
+	}))
+	defer server.Close()
+
+	// Gzip body with retried temporary failure
+	h := NewHTTP(time.Second, 2, time.Millisecond, true)
+	statuses = []int{503}
+	assert.NoError(h.Post(server.URL, http.Header{"X-Test": {"1"}}, []byte("payload")))
+	assert.Equal([]string{"payload", "payload"}, received)
+	assert.Equal("gzip", encoding)
+	assert.Equal(userAgent, agent)
+
+	// Client errors are not retried
+	h = NewHTTP(time.Second, 2, time.Millisecond, false)
+	received, statuses = nil, []int{400}
+	err := h.Post(server.URL, nil, []byte("payload"))
+	assert.Equal(StatusError{Code: 400, Body: "rejected"}, err)
+	assert.Equal([]string{"payload"}, received)
+	assert.Empty(encoding)
+
+	// Retries are limited
+	received, statuses = nil, []int{500, 500, 500, 500}
+	err = h.Post(server.URL, nil, []byte("payload"))
+	assert.Equal(StatusError{Code: 500, Body: "rejected"}, err)
+	assert.Len(received, 3)
+}
@@ -1,52 +1,83 @@
 package udp
 
 import (
-	"bytes"
+	"github.com/mono83/dogrelay/influxdb"
 	"github.com/mono83/dogrelay/metrics"
 	"github.com/mono83/udpwriter"
 	"github.com/mono83/xray"
 	"io"
-	"strconv"
 	"time"
 )
 
+// DefaultPayloadSize is default max size of single datagram, sent to
+// InfluxDB. It fits into common 1500 bytes MTU with IP and UDP headers.
+const DefaultPayloadSize = 1400
+
 // InfluxDBSender is adapter, used to send metrics events to InfluxDB
 type InfluxDBSender struct {
-	writer io.Writer
-	log    xray.Ray
+	writer      io.Writer
+	log         xray.Ray
+	encoder     influxdb.Encoder
+	payloadSize int
 }
 
-// NewInfluxDBSender builds and returns new adapter for InfluxDB
-func NewInfluxDBSender(addr string) (*InfluxDBSender, error) {
+// NewInfluxDBSender builds and returns new adapter for InfluxDB.
+// Lines are packed into datagrams up to given payload size,
+// zero means DefaultPayloadSize.
+func NewInfluxDBSender(addr string, payloadSize int, encoder influxdb.Encoder) (*InfluxDBSender, error) {
+	if err := encoder.Validate(); err != nil {
+		return nil, err
+	}
+
 	var err error
 	snd := new(InfluxDBSender)
+	snd.encoder = encoder
 	snd.writer, err = udpwriter.NewS(addr)
 	if err != nil {
 		return nil, err
 	}
 
+	if payloadSize <= 0 {
+		payloadSize = DefaultPayloadSize
+	}
+	snd.payloadSize = payloadSize
 	snd.log = xray.ROOT.Fork().WithLogger("indfluxdb-sender").WithMetricPrefix("influxdb")
 
 	return snd, nil
 }
 
-// Send sends packet to InfluxDB
-func (i *InfluxDBSender) Send(e metrics.Event) {
-	// Converting to influxdb format
-	buf := bytes.NewBufferString(e.Metric)
-	if len(e.Params) > 0 {
-		for _, param := range e.Params {
-			buf.WriteRune(',')
-			buf.WriteString(param)
+// Write sends all given events, flushed at given time, to InfluxDB,
+// packing as many lines into single datagram as payload size allows.
+// Lines longer than payload size are sent in own datagrams.
+func (i *InfluxDBSender) Write(ts time.Time, events []metrics.Event) error {
+	before := time.Now()
+
+	var datagrams, size int
+	var err error
+	buf := make([]byte, 0, i.payloadSize)
+	send := func() {
+		if _, werr := i.writer.Write(buf); werr != nil && err == nil {
+			err = werr
 		}
+		datagrams++
+		size += len(buf)
+		buf = buf[:0]
+	}
+	i.encoder.Each(ts, events, func(line []byte) {
+		if len(buf) > 0 && len(buf)+len(line) > i.payloadSize {
+			send()
+		}
+		buf = append(buf, line...)
+	})
+	if len(buf) > 0 {
+		send()
+	}
+	if err != nil {
+		return err
 	}
-	buf.WriteString(" value=")
-	buf.WriteString(strconv.FormatInt(e.Value, 10))
-	buf.WriteRune('\n')
-
-	i.log.Increment("flush.size", int64(buf.Len()))
 
-	before := time.Now()
-	_, _ = i.writer.Write(buf.Bytes())
+	i.log.Increment("flush.datagrams", int64(datagrams))
+	i.log.Increment("flush.size", int64(size))
 	i.log.Duration("flush.latency", time.Now().Sub(before))
+	return nil
 }
@@ -0,0 +1,45 @@
+package udp
+
+import (
+	"github.com/mono83/dogrelay/metrics"
+	"github.com/mono83/xray"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+type datagramRecorder [][]byte
+
+func (d *datagramRecorder) Write(b []byte) (int, error) {
+	*d = append(*d, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestInfluxDBSenderWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	var rec datagramRecorder
+	snd := &InfluxDBSender{writer: &rec, log: xray.ROOT.Fork(), payloadSize: 64}
+
+	var events []metrics.Event
+	for i := 0; i < 10; i++ {
+		events = append(events, metrics.Event{Metric: "cpu", Value: int64(i), Params: []string{"host=a"}})
+	}
+	events = append(events, metrics.Event{Metric: strings.Repeat("x", 100), Value: 1})
+
+	if assert.NoError(snd.Write(time.Time{}, events)) {
+		var lines []string
+		for _, d := range rec {
+			if len(d) > 64 {
+				// Only oversized line may exceed payload
+				assert.Equal(strings.Repeat("x", 100)+" value=1\n", string(d))
+			}
+			assert.True(strings.HasSuffix(string(d), "\n"))
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")...)
+		}
+		assert.Len(rec, 5)
+		assert.Len(lines, 11)
+		assert.Equal("cpu,host=a value=0", lines[0])
+	}
+}
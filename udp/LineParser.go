@@ -0,0 +1,227 @@
+package udp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mono83/dogrelay/metrics"
+)
+
+// List of parsing errors
+var (
+	errInvalidFormat = errors.New("Invalid format string")
+	errInvalidValue  = errors.New("invalid metric value")
+)
+
+// lineParser reads DogStatsD lines directly into metric keys in
+// metrics.Event.AppendKey format. Parser reuses own buffers, so after
+// warm up it does not allocate memory. It is not safe for concurrent use.
+type lineParser struct {
+	key     []byte
+	tags    []byte
+	offsets [][2]int
+}
+
+// readAll parses all lines of given packet and delivers them to callback.
+// Malformed lines are skipped, first error is returned.
+func (p *lineParser) readAll(bts []byte, to func([]byte, int64)) error {
+	var first error
+	for len(bts) > 0 {
+		var line []byte
+		line, bts = nextChunk(bts, '\n')
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		value, err := p.parse(line)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		to(p.key, value)
+	}
+
+	return first
+}
+
+// parse reads single line into parser key buffer and returns metric value
+func (p *lineParser) parse(line []byte) (int64, error) {
+	colon := bytes.IndexByte(line, ':')
+	if colon < 0 {
+		return 0, errInvalidFormat
+	}
+	metric := line[:colon]
+	if len(metric) == 0 {
+		return 0, errInvalidFormat
+	}
+	valueString, rest := nextChunk(line[colon+1:], '|')
+	typeString, rest := nextChunk(rest, '|')
+	if len(typeString) == 0 {
+		return 0, errInvalidFormat
+	}
+	value, ok := parseInt(valueString)
+	if !ok {
+		return 0, errInvalidValue
+	}
+
+	var eventType byte
+	switch string(typeString) {
+	case "c":
+		eventType = metrics.TypeIncrement
+	case "g":
+		eventType = metrics.TypeGauge
+	case "ms":
+		eventType = metrics.TypeDuration
+	default:
+		return 0, fmt.Errorf("unsupported format %s", typeString)
+	}
+
+	// Remaining chunks are sample rate, which is ignored, and tags
+	var tags []byte
+	for len(rest) > 0 {
+		var chunk []byte
+		chunk, rest = nextChunk(rest, '|')
+		if len(chunk) > 0 && chunk[0] == '#' {
+			tags = chunk[1:]
+		}
+	}
+
+	p.key = append(p.key[:0], eventType, '\t')
+	p.key = append(p.key, metric...)
+	sanitize(p.key[2:])
+	p.key = append(p.key, '\t')
+	p.appendTags(tags)
+
+	return value, nil
+}
+
+// appendTags appends sorted and deduplicated tags to key buffer
+func (p *lineParser) appendTags(tags []byte) {
+	p.tags = p.tags[:0]
+	p.offsets = p.offsets[:0]
+	for len(tags) > 0 {
+		var tag []byte
+		tag, tags = nextChunk(tags, ',')
+		tag = bytes.TrimSpace(tag)
+		if len(tag) == 0 {
+			// Empty param
+			continue
+		}
+
+		// Converting name:value into name=value
+		start := len(p.tags)
+		p.tags = append(p.tags, tag...)
+		sanitize(p.tags[start:])
+		if i := bytes.IndexByte(tag, ':'); i >= 0 {
+			// Equals sign separates tag name from value,
+			// so it is not allowed within name
+			for j := start; j < start+i; j++ {
+				if p.tags[j] == '=' {
+					p.tags[j] = '_'
+				}
+			}
+			p.tags[start+i] = '='
+		}
+		p.offsets = append(p.offsets, [2]int{start, len(p.tags)})
+	}
+
+	// Insertion sort - tags count is small and sort.Slice allocates
+	for i := 1; i < len(p.offsets); i++ {
+		for j := i; j > 0 && bytes.Compare(p.tag(j), p.tag(j-1)) < 0; j-- {
+			p.offsets[j], p.offsets[j-1] = p.offsets[j-1], p.offsets[j]
+		}
+	}
+
+	for i := range p.offsets {
+		if i > 0 {
+			if bytes.Equal(p.tag(i), p.tag(i-1)) {
+				// Duplicate
+				continue
+			}
+			p.key = append(p.key, '\t')
+		}
+		p.key = append(p.key, p.tag(i)...)
+	}
+}
+
+func (p *lineParser) tag(i int) []byte {
+	return p.tags[p.offsets[i][0]:p.offsets[i][1]]
+}
+
+// sanitize replaces control characters, including tabs used as key
+// separators and line breaks, with underscores in place
+func sanitize(b []byte) {
+	for i, c := range b {
+		if c < 0x20 || c == 0x7f {
+			b[i] = '_'
+		}
+	}
+}
+
+// nextChunk splits given bytes by first occurrence of separator
+func nextChunk(b []byte, sep byte) (chunk, rest []byte) {
+	if i := bytes.IndexByte(b, sep); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// parseInt parses signed decimal integer without allocations
+func parseInt(b []byte) (int64, bool) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		b = b[1:]
+	}
+	if len(b) == 0 {
+		return 0, false
+	}
+
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' || n > (1<<63)/10 {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	if n > 1<<63 || (!neg && n == 1<<63) {
+		return 0, false
+	}
+	if neg {
+		return -int64(n), true
+	}
+	return int64(n), true
+}
+
+// multiLineRead parses all lines of given packet into events.
+// Unlike lineParser it allocates memory for every event.
+func multiLineRead(bts []byte) ([]metrics.Event, error) {
+	var p lineParser
+	var result []metrics.Event
+	err := p.readAll(bts, func(key []byte, value int64) {
+		e := metrics.EventFromKey(string(key))
+		e.Value = value
+		result = append(result, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// singleLineRead parses single line into event
+func singleLineRead(str string) (metrics.Event, error) {
+	var p lineParser
+	value, err := p.parse([]byte(str))
+	if err != nil {
+		return metrics.Event{}, err
+	}
+
+	e := metrics.EventFromKey(string(p.key))
+	e.Value = value
+	return e, nil
+}
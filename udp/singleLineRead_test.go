@@ -3,6 +3,7 @@ package udp
 import (
 	"github.com/mono83/dogrelay/metrics"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -81,3 +82,70 @@ func TestSingleLineRead(t *testing.T) {
 	}
 
 }
+
+func TestLineParserAllocs(t *testing.T) {
+	assert := assert.New(t)
+
+	packet := []byte("users.online:800|g|@0.5|#country:china,server:china-1\nfoo:1|c\nlatency:344|ms|#b:2,a:1,b:2\n")
+	buf := metrics.NewShardedBuffer(4, []int{95}, false)
+	var p lineParser
+
+	// Warming up parser buffers and registering series
+	for i := 0; i < 100; i++ {
+		assert.NoError(p.readAll(packet, buf.AddKey))
+	}
+
+	assert.Zero(testing.AllocsPerRun(100, func() {
+		_ = p.readAll(packet, buf.AddKey)
+	}))
+}
+
+func TestLineParserTags(t *testing.T) {
+	assert := assert.New(t)
+
+	event, err := singleLineRead("latency:344|ms|#b:2,a:1,b:2")
+	if assert.NoError(err) {
+		assert.Equal([]string{"a=1", "b=2"}, event.Params)
+	}
+	event, err = singleLineRead("a\tb:1|c|#x=y:z w,q\x00:1")
+	if assert.NoError(err) {
+		assert.Equal("a_b", event.Metric)
+		assert.Equal([]string{"q_=1", "x_y=z w"}, event.Params)
+	}
+	_, err = singleLineRead(":1|c")
+	assert.Error(err)
+	_, err = singleLineRead("foo:1.5|c")
+	assert.Error(err)
+	_, err = singleLineRead("foo:1|x")
+	assert.Error(err)
+	_, err = singleLineRead("foo|c")
+	assert.Error(err)
+}
+
+func FuzzLineParser(f *testing.F) {
+	f.Add([]byte("users.online:800|g|@0.5|#country:china,server:china-1"))
+	f.Add([]byte("foo:1|c\nbar:-2|ms|#a=b:c,d"))
+	f.Add([]byte("a\tb:1|c|#x\ty:z\x00"))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		var p lineParser
+		_ = p.readAll(packet, func(key []byte, value int64) {
+			e := metrics.EventFromKey(string(key))
+			if len(e.Metric) == 0 {
+				t.Fatalf("empty metric name in key %q", key)
+			}
+			for _, s := range append([]string{e.Metric}, e.Params...) {
+				for _, c := range []byte(s) {
+					if c < 0x20 || c == 0x7f {
+						t.Fatalf("control character in key %q", key)
+					}
+				}
+			}
+			for _, param := range e.Params {
+				if i := strings.IndexByte(param, '='); i >= 0 && strings.ContainsRune(param[:i], ':') {
+					t.Fatalf("tag separator within tag name in %q", param)
+				}
+			}
+		})
+	})
+}